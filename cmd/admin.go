@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ooni/collector/collector/auth"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// adminCmd groups the commands used to manage admin credentials
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Manage the credentials of the admin API",
+}
+
+// readPassword reads a password from the terminal without echoing it, or
+// a line from stdin when it's not a terminal
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password",
+	Short: "Hash a password for the api.admin-users config",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if password == "" {
+			return errors.New("empty password")
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(hash))
+		return nil
+	},
+}
+
+var genTokenCmd = &cobra.Command{
+	Use:   "gen-token <name>",
+	Short: "Generate an API token for the api.admin-tokens config",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		roleName, _ := cmd.Flags().GetString("role")
+		if _, err := auth.ParseRole(roleName); err != nil {
+			return err
+		}
+		validity, _ := cmd.Flags().GetDuration("expires-in")
+
+		t, err := auth.GenerateToken()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "token (shown only once): %s\n\n", t)
+		fmt.Println("[[api.admin-tokens]]")
+		fmt.Printf("name = %q\n", args[0])
+		fmt.Printf("token-hash = %q\n", auth.HashToken(t))
+		fmt.Printf("role = %q\n", roleName)
+		if validity > 0 {
+			fmt.Printf("expires = %q\n", time.Now().UTC().Add(validity).Format(time.RFC3339))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(adminCmd)
+	adminCmd.AddCommand(hashPasswordCmd)
+	adminCmd.AddCommand(genTokenCmd)
+
+	genTokenCmd.Flags().String("role", "read-only", "Role of the token (read-only, operator or admin)")
+	genTokenCmd.Flags().Duration("expires-in", 90*24*time.Hour, "Validity of the token, 0 means it never expires")
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ooni/collector/collector/config"
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configCmd groups the commands used to inspect the configuration
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the configuration",
+	Long: `Loads the configuration file, the environment and the command line
+flags the way start does and reports all the problems found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := config.Load(viper.GetViper()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration OK")
+	},
+}
+
+// redactSettings hides the secret values of the nested settings
+func redactSettings(prefix string, settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			out[key] = redactSettings(prefix+key+".", nested)
+			continue
+		}
+		out[key] = config.Redact(prefix+key, value)
+	}
+	return out
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the configuration as TOML",
+	Long: `Prints the settings of the configuration file. With --effective it
+prints the settings the collector would run with instead, including the
+defaults, the environment and the command line flags.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		effective, _ := cmd.Flags().GetBool("effective")
+		showSecrets, _ := cmd.Flags().GetBool("show-secrets")
+
+		var settings map[string]interface{}
+		if effective {
+			settings = viper.AllSettings()
+		} else {
+			path := config.File()
+			if path == "" {
+				return errors.New("no configuration file in use")
+			}
+			v := viper.New()
+			v.SetConfigFile(path)
+			if err := v.ReadInConfig(); err != nil {
+				return err
+			}
+			settings = v.AllSettings()
+		}
+		if !showSecrets {
+			settings = redactSettings("", settings)
+		}
+		tree, err := toml.TreeFromMap(settings)
+		if err != nil {
+			return err
+		}
+		out, err := tree.ToTomlString()
+		if err != nil {
+			return err
+		}
+		fmt.Print(out)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configCheckCmd)
+	configCmd.AddCommand(configDumpCmd)
+
+	configDumpCmd.Flags().Bool("effective", false, "Print the settings in effect, defaults included")
+	configDumpCmd.Flags().Bool("show-secrets", false, "Do not redact passwords, keys and tokens")
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/spf13/cobra"
+)
+
+// reportsCmd groups the commands used to inspect and manage the reports
+// while the collector is stopped
+var reportsCmd = &cobra.Command{
+	Use:   "reports",
+	Short: "Inspect and manage the reports in the store",
+	Long: `These commands open the store directly, so the collector must be
+stopped. While it's running use the admin API instead.`,
+}
+
+// openStore opens the store of the data root of cfg, refusing to share it
+// with a running collector. It sets up the reports with cfg as well.
+func openStore(cfg *config.Config) (*storage.Storage, error) {
+	if err := report.Init(cfg); err != nil {
+		return nil, err
+	}
+	store := storage.New(paths.BadgerDir(cfg.Core.DataRoot), cfg.Store)
+	err := store.Init()
+	if err == storage.ErrStoreLocked {
+		return nil, errors.New("the store is in use by a running collector, stop it or use the admin API")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reportFilterFlags adds the flags used to select reports to cmd
+func reportFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("state", "", "Only the reports in this state (open or closed)")
+	cmd.Flags().String("test", "", "Only the reports of this test_name")
+	cmd.Flags().String("cc", "", "Only the reports from this probe_cc")
+	cmd.Flags().String("asn", "", "Only the reports from this probe_asn")
+	cmd.Flags().Duration("idle", 0, "Only the reports not updated for this duration")
+}
+
+// findReports returns the reports selected by the filter flags of cmd,
+// the oldest first
+func findReports(cmd *cobra.Command, store *storage.Storage) ([]*storage.ReportMetadata, error) {
+	var f storage.Filter
+	f.State, _ = cmd.Flags().GetString("state")
+	f.TestName, _ = cmd.Flags().GetString("test")
+	f.ProbeCC, _ = cmd.Flags().GetString("cc")
+	f.ProbeASN, _ = cmd.Flags().GetString("asn")
+	if idle, _ := cmd.Flags().GetDuration("idle"); idle > 0 {
+		f.UpdatedBefore = time.Now().UTC().Add(-idle)
+	}
+	switch f.State {
+	case "", storage.StateOpen, storage.StateClosed:
+	default:
+		return nil, fmt.Errorf("invalid state %q. Must be open or closed", f.State)
+	}
+
+	reports, err := store.FindReports(context.Background(), f)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].CreationTime.Before(reports[j].CreationTime)
+	})
+	return reports, nil
+}
+
+func writeReportTable(w io.Writer, reports []*storage.ReportMetadata) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPORT ID\tSTATE\tTEST\tCC\tASN\tENTRIES\tCREATED\tUPDATED")
+	for _, meta := range reports {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			meta.ReportID,
+			meta.State(),
+			meta.TestName,
+			meta.ProbeCC,
+			meta.ProbeASN,
+			meta.EntryCount,
+			meta.CreationTime.Format(time.RFC3339),
+			meta.LastUpdateTime.Format(time.RFC3339),
+		)
+	}
+	return tw.Flush()
+}
+
+var reportsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the reports",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		reports, err := findReports(cmd, store)
+		if err != nil {
+			return err
+		}
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "table":
+			return writeReportTable(os.Stdout, reports)
+		case "json":
+			if reports == nil {
+				reports = []*storage.ReportMetadata{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(reports)
+		}
+		return fmt.Errorf("invalid output %q. Must be table or json", output)
+	},
+}
+
+var reportsShowCmd = &cobra.Command{
+	Use:   "show <report-id>",
+	Short: "Show the metadata of a report",
+	Long: `Prints the metadata of the report or, once it expired, the compact record
+kept for store.tombstone-ttl.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ctx := context.Background()
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		meta, err := store.GetReport(ctx, args[0])
+		if err == storage.ErrReportNotFound {
+			tombstone, terr := store.GetTombstone(ctx, args[0])
+			if terr != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "the metadata of the report expired, showing its tombstone")
+			return enc.Encode(tombstone)
+		}
+		if err != nil {
+			return err
+		}
+		return enc.Encode(meta)
+	},
+}
+
+var reportsCloseCmd = &cobra.Command{
+	Use:   "close [<report-id>]",
+	Short: "Close a report, or every report older than --older-than",
+	Long: `Closes the report, moving its file to the reports folder. The closed
+reports are not shipped to AWS, run upload once the collector is back.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		olderThan, _ := cmd.Flags().GetDuration("older-than")
+		if (len(args) == 1) == (olderThan > 0) {
+			return errors.New("either a report id or --older-than is required")
+		}
+
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ctx := context.Background()
+		if len(args) == 1 {
+			if err = report.CloseReport(ctx, store, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("closed %s\n", args[0])
+			return nil
+		}
+		closed, err := report.CloseReportsOlderThan(ctx, store, time.Now().UTC().Add(-olderThan))
+		if err != nil {
+			return err
+		}
+		for _, reportID := range closed {
+			fmt.Printf("closed %s\n", reportID)
+		}
+		return nil
+	},
+}
+
+var reportsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the metadata of the reports as JSON lines or CSV",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		if format != "jsonl" && format != "csv" {
+			return fmt.Errorf("invalid format %q. Must be jsonl or csv", format)
+		}
+
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		reports, err := findReports(cmd, store)
+		if err != nil {
+			return err
+		}
+
+		var w io.Writer = os.Stdout
+		if path, _ := cmd.Flags().GetString("output"); path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		if format == "jsonl" {
+			enc := json.NewEncoder(w)
+			for _, meta := range reports {
+				if err = enc.Encode(meta); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{
+			"report_id", "state", "test_name", "probe_cc", "probe_asn",
+			"platform", "software_name", "software_version", "entry_count",
+			"creation_time", "last_update_time", "report_file_path",
+		})
+		for _, meta := range reports {
+			cw.Write([]string{
+				meta.ReportID,
+				meta.State(),
+				meta.TestName,
+				meta.ProbeCC,
+				meta.ProbeASN,
+				meta.Platform,
+				meta.SoftwareName,
+				meta.SoftwareVersion,
+				strconv.FormatInt(meta.EntryCount, 10),
+				meta.CreationTime.Format(time.RFC3339),
+				meta.LastUpdateTime.Format(time.RFC3339),
+				meta.ReportFilePath,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reportsCmd)
+	reportsCmd.AddCommand(reportsListCmd)
+	reportsCmd.AddCommand(reportsShowCmd)
+	reportsCmd.AddCommand(reportsCloseCmd)
+	reportsCmd.AddCommand(reportsExportCmd)
+
+	reportFilterFlags(reportsListCmd)
+	reportsListCmd.Flags().StringP("output", "o", "table", "Output format (table or json)")
+	reportsCloseCmd.Flags().Duration("older-than", 0, "Close every open report created before this duration")
+	reportFilterFlags(reportsExportCmd)
+	reportsExportCmd.Flags().String("format", "jsonl", "Export format (jsonl or csv)")
+	reportsExportCmd.Flags().StringP("output", "o", "", "Write to this file instead of stdout")
+}
@@ -6,7 +6,8 @@ import (
 	"strings"
 
 	apexLog "github.com/apex/log"
-	"github.com/apex/log/handlers/cli"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/logging"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -44,12 +45,15 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	config.SetDefaults(viper.GetViper())
 
 	RootCmd.PersistentFlags().Bool("dev", false, "run in development mode")
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./ooni-collector.toml)")
 	RootCmd.PersistentFlags().StringP("log-level", "", "info", "Set the log level")
+	RootCmd.PersistentFlags().StringP("log-format", "", "text", "Set the log format (text, json or logfmt)")
 	RootCmd.PersistentFlags().StringP("data-root", "", "/var/ooni-collector", "In which directory we should be writing working files to")
 	viper.BindPFlag("core.log-level", RootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("core.log-format", RootCmd.PersistentFlags().Lookup("log-format"))
 	viper.BindPFlag("core.data-root", RootCmd.PersistentFlags().Lookup("data-root"))
 	viper.BindPFlag("core.is-dev", RootCmd.PersistentFlags().Lookup("dev"))
 }
@@ -74,10 +78,8 @@ func initConfig() {
 		log.WithError(err).Errorf("using default configuration")
 	}
 
-	apexLog.SetHandler(cli.Default)
-	level, err := apexLog.ParseLevel(viper.GetString("core.log-level"))
+	err := logging.Setup(viper.GetString("core.log-format"), viper.GetString("core.log-level"))
 	if err != nil {
-		fmt.Println("Invalid log level. Must be one of debug, info, warn, error, fatal")
+		fmt.Println(err)
 	}
-	apexLog.SetLevel(level)
 }
@@ -1,7 +1,11 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/ooni/collector/collector"
+	"github.com/ooni/collector/collector/config"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -12,7 +16,12 @@ var startCmd = &cobra.Command{
 	Short: "Start the collector service",
 	Long:  `This is the main entrypoint for starting the collector service`,
 	Run: func(cmd *cobra.Command, args []string) {
-		collector.Start()
+		cfg, err := config.Init()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		collector.Start(cfg)
 	},
 }
 
@@ -23,10 +32,4 @@ func init() {
 	startCmd.PersistentFlags().StringP("address", "", "127.0.0.1", "Which interface we should listen on")
 	viper.BindPFlag("api.port", startCmd.PersistentFlags().Lookup("port"))
 	viper.BindPFlag("api.address", startCmd.PersistentFlags().Lookup("address"))
-	viper.SetDefault("api.admin-password", "changeme")
-	viper.SetDefault("api.fqn", "unknown")
-	viper.SetDefault("aws.access-key-id", "")
-	viper.SetDefault("aws.secret-access-key", "")
-	viper.SetDefault("aws.s3-bucket", "ooni-collector")
-	viper.SetDefault("aws.s3-prefix", "reports")
 }
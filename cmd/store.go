@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/spf13/cobra"
+)
+
+// storeCmd groups the commands used to maintain the store
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Back up, restore and maintain the store",
+}
+
+var storeBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Back up the report metadata",
+	Long: `Writes the metadata of every report as JSON lines, with a version
+header and checksums, to stdout or to the file given with --output. The
+collector must be stopped, use POST /admin/store/backup while it's running.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var (
+			ctx      = context.Background()
+			dataRoot = cfg.Core.DataRoot
+			trailer  *storage.BackupTrailer
+		)
+		if path, _ := cmd.Flags().GetString("output"); path != "" {
+			trailer, err = store.BackupFile(ctx, path, dataRoot)
+		} else {
+			trailer, err = store.Backup(ctx, os.Stdout, dataRoot)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d reports (%s)\n", trailer.Count, trailer.Checksum)
+		return nil
+	},
+}
+
+var storeRestoreCmd = &cobra.Command{
+	Use:   "restore <backup-file>",
+	Short: "Restore the report metadata from a backup",
+	Long: `Checks the backup then writes its reports to the store, replacing the
+reports with the same ID. The paths of the report files are moved to the
+data root of this collector.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		header, _, err := storage.VerifyBackup(f)
+		if err != nil {
+			return err
+		}
+		if verifyOnly, _ := cmd.Flags().GetBool("verify-only"); verifyOnly {
+			fmt.Printf("backup of %s by collector %s is valid\n",
+				header.CreationTime.Format("2006-01-02 15:04:05"), header.CollectorVersion)
+			return nil
+		}
+		if _, err = f.Seek(0, 0); err != nil {
+			return err
+		}
+
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		trailer, err := store.Restore(context.Background(), f, cfg.Core.DataRoot)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("restored %d reports\n", trailer.Count)
+		return nil
+	},
+}
+
+var storeMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the store to the schema of this collector",
+	Long: `Runs the pending migrations of the store. start runs them as well, this
+command allows to run them ahead of time, ex. before an upgrade.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		version, err := store.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("the store is at schema version %d\n", version)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(storeCmd)
+	storeCmd.AddCommand(storeBackupCmd)
+	storeCmd.AddCommand(storeRestoreCmd)
+	storeCmd.AddCommand(storeMigrateCmd)
+
+	storeBackupCmd.Flags().StringP("output", "o", "", "Write the backup to this file instead of stdout")
+	storeRestoreCmd.Flags().Bool("verify-only", false, "Only check the backup")
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ooni/collector/collector/aws"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/spf13/cobra"
+)
+
+var uploadCmd = &cobra.Command{
+	Use:   "upload",
+	Short: "Ship the closed reports that have not reached AWS",
+	Long: `Scans the reports folder and uploads the closed reports that have not
+reached all the sinks (SQS and S3) yet, recording the outcome in their
+metadata. Like the reports commands it opens the store directly, so the
+collector must be stopped.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		all, _ := cmd.Flags().GetBool("all")
+		if concurrency < 1 {
+			return errors.New("concurrency must be at least 1")
+		}
+
+		cfg, err := config.Init()
+		if err != nil {
+			return err
+		}
+		if !cfg.AWS.Enabled() && !dryRun {
+			return errors.New("aws.access-key-id is not set, there is nowhere to upload to")
+		}
+
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		ctx := context.Background()
+		pending, err := report.PendingUploads(ctx, store, all)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			for _, meta := range pending {
+				fmt.Printf("would upload %s (%d entries, %d failed attempts)\n",
+					meta.ReportFilePath, meta.EntryCount, meta.UploadAttempts)
+			}
+			fmt.Printf("%d reports to upload\n", len(pending))
+			return nil
+		}
+		aws.Session = aws.NewSession(cfg.AWS.AccessKeyID, cfg.AWS.SecretAccessKey)
+
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			done     int
+			failed   int
+			reports  = make(chan *storage.ReportMetadata)
+			progress = func(meta *storage.ReportMetadata, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				done++
+				if err != nil {
+					failed++
+					fmt.Printf("[%d/%d] failed %s: %v\n", done, len(pending), meta.ReportID, err)
+					return
+				}
+				fmt.Printf("[%d/%d] uploaded %s\n", done, len(pending), meta.ReportID)
+			}
+		)
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for meta := range reports {
+					progress(meta, report.UploadReport(ctx, store, meta))
+				}
+			}()
+		}
+		for _, meta := range pending {
+			reports <- meta
+		}
+		close(reports)
+		wg.Wait()
+
+		fmt.Printf("uploaded %d reports, %d failed\n", done-failed, failed)
+		if failed > 0 {
+			return fmt.Errorf("%d uploads failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(uploadCmd)
+
+	uploadCmd.Flags().Int("concurrency", 4, "How many reports are uploaded at the same time")
+	uploadCmd.Flags().Bool("dry-run", false, "Only list the reports that would be uploaded")
+	uploadCmd.Flags().Bool("all", false, "Upload again the reports that were already uploaded")
+}
@@ -6,9 +6,14 @@ import (
 
 	apexLog "github.com/apex/log"
 	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/auth"
+	"github.com/ooni/collector/collector/diskguard"
 	"github.com/ooni/collector/collector/handler"
+	"github.com/ooni/collector/collector/health"
+	"github.com/ooni/collector/collector/metrics"
 	"github.com/ooni/collector/collector/paths"
-	"github.com/spf13/viper"
+	"github.com/ooni/collector/collector/ratelimit"
+	"github.com/ooni/collector/collector/tracing"
 	ginprometheus "github.com/zsais/go-gin-prometheus"
 )
 
@@ -17,9 +22,11 @@ var log = apexLog.WithFields(apexLog.Fields{
 	"cmd": "ooni-collector",
 })
 
-// BindAPI bind all the request handlers and middleware
-func BindAPI(router *gin.Engine) error {
-	p := ginprometheus.NewPrometheus("oonicollector", handler.CustomMetrics)
+// BindAPI bind all the request handlers and middleware. The admin API serves
+// and manages the files of dataRoot.
+func BindAPI(router *gin.Engine, dataRoot string, guard *diskguard.Guard, checker *health.Checker, authn *auth.Authenticator, limits *ratelimit.Limits) error {
+	metrics.Register()
+	p := ginprometheus.NewPrometheus(metrics.Subsystem)
 	ignoredParams := []string{"reportID", "filename"}
 	p.ReqCntURLLabelMappingFn = func(c *gin.Context) string {
 		url := c.Request.URL.String()
@@ -34,23 +41,44 @@ func BindAPI(router *gin.Engine) error {
 		return url
 	}
 	p.Use(router)
+	router.Use(tracing.Middleware())
+
+	newReportGuard := guard.NewReportMiddleware()
+	submissionGuard := guard.SubmissionMiddleware()
+	createLimit := limits.Middleware(ratelimit.KindCreate)
+	submitLimit := limits.Middleware(ratelimit.KindSubmit)
 
 	// This is to support legacy clients
-	router.POST("/report", handler.CreateReportHandler)
+	router.POST("/report", createLimit, newReportGuard, handler.CreateReportHandler)
 	router.PUT("/report", handler.DeprecatedUpdateReportHandler)
-	router.POST("/report/:reportID", handler.UpdateReportHandler)
+	router.POST("/report/:reportID", submitLimit, submissionGuard, handler.UpdateReportHandler)
 	router.POST("/report/:reportID/close", handler.CloseReportHandler)
 
 	v1 := router.Group("/api/v1")
-	v1.POST("/report", handler.CreateReportHandler)
-	v1.POST("/report/:reportID", handler.UpdateReportHandler)
+	v1.POST("/report", createLimit, newReportGuard, handler.CreateReportHandler)
+	v1.POST("/report/:reportID", submitLimit, submissionGuard, handler.UpdateReportHandler)
 	v1.POST("/report/:reportID/close", handler.CloseReportHandler)
-	v1.POST("/measurement", handler.SubmitMeasurementHandler)
+	v1.POST("/measurement", submitLimit, submissionGuard, handler.SubmitMeasurementHandler)
+
+	router.GET("/health", checker.LiveHandler)
+	router.GET("/health/disk", guard.HealthHandler)
+	router.GET("/ready", checker.ReadyHandler)
+
+	readOnly := authn.Require(auth.RoleReadOnly)
+	operator := authn.Require(auth.RoleOperator)
+	adminOnly := authn.Require(auth.RoleAdmin)
+
+	admin := router.Group("/admin")
+	admin.DELETE("/report-file/:filename", operator, handler.DeleteReportFileHandler(dataRoot))
+	admin.POST("/report/:reportID/close", operator, handler.AdminCloseReportHandler)
+	admin.POST("/report/:reportID/reopen", operator, handler.AdminReopenReportHandler)
+	admin.DELETE("/report/:reportID", operator, handler.AdminPurgeReportHandler)
+	admin.POST("/reports/close", operator, handler.AdminCloseReportsHandler)
+	admin.GET("/audit", adminOnly, handler.AuditHandler)
+	admin.POST("/config/reload", adminOnly, handler.AdminReloadConfigHandler)
+	admin.POST("/store/backup", adminOnly, handler.AdminBackupHandler(dataRoot))
 
-	admin := router.Group("/admin", gin.BasicAuth(gin.Accounts{
-		"admin": viper.GetString("api.admin-password"),
-	}))
-	admin.DELETE("/report-file/:filename", handler.DeleteReportFileHandler)
-	admin.StaticFS("/report-files", http.Dir(paths.ReportDir()))
+	files := admin.Group("/report-files", readOnly, handler.AuditReportFileDownloads)
+	files.StaticFS("/", http.Dir(paths.ReportDir(dataRoot)))
 	return nil
 }
@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "audit",
+	"cmd": "ooni-collector",
+})
+
+const (
+	// OutcomeSuccess is the outcome of an action that succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure is the outcome of an action that failed
+	OutcomeFailure = "failure"
+)
+
+// Entry is a record of an admin action
+type Entry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+}
+
+// Log is an append-only audit log stored as one JSON entry per line
+type Log struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// Open opens, or creates, the audit log at path
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{path: path, f: f}, nil
+}
+
+// Record appends the entry to the audit log and syncs it to disk
+func (l *Log) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	ctx := log.WithFields(apexLog.Fields{
+		"user":        e.User,
+		"remote_addr": e.RemoteAddr,
+		"action":      e.Action,
+		"target":      e.Target,
+		"outcome":     e.Outcome,
+	})
+	if e.RequestID != "" {
+		ctx = ctx.WithField("request_id", e.RequestID)
+	}
+	if e.Outcome == OutcomeFailure {
+		ctx.WithField("error", e.Error).Warn("admin action failed")
+	} else {
+		ctx.Info("admin action succeeded")
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err = l.f.Write(line); err != nil {
+		log.WithError(err).Error("failed to write audit entry")
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Query selects audit entries. Empty fields match everything.
+type Query struct {
+	Action string
+	User   string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of entries to return, 0 means no limit
+	Limit int
+}
+
+func (q Query) matches(e *Entry) bool {
+	if q.Action != "" && e.Action != q.Action {
+		return false
+	}
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if q.Target != "" && e.Target != q.Target {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// blockSize is how much of the log is read at once by scanBackward
+const blockSize = 64 * 1024
+
+// scanBackward calls fn with every line of f, the last one first, until fn
+// returns false
+func scanBackward(f *os.File, fn func(line []byte) bool) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var (
+		buf = make([]byte, blockSize)
+		// head is the beginning of the file not yet split into lines
+		head []byte
+	)
+	for offset > 0 {
+		n := int64(blockSize)
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err = f.ReadAt(buf[:n], offset); err != nil {
+			return err
+		}
+		head = append(append([]byte{}, buf[:n]...), head...)
+		// Only the text after a newline is known to be a whole line
+		for i := bytes.LastIndexByte(head, '\n'); i >= 0; i = bytes.LastIndexByte(head, '\n') {
+			if line := head[i+1:]; len(line) > 0 && !fn(line) {
+				return nil
+			}
+			head = head[:i]
+		}
+	}
+	if len(head) > 0 {
+		fn(head)
+	}
+	return nil
+}
+
+// Find returns the entries matching the query, the most recent first. The
+// log is read backwards from its end, so that only the matching entries are
+// kept in memory and reading stops once the limit is reached.
+func (l *Log) Find(q Query) ([]Entry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	err = scanBackward(f, func(line []byte) bool {
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.WithError(err).Warn("skipping malformed audit entry")
+			return true
+		}
+		if q.matches(&e) {
+			entries = append(entries, e)
+		}
+		return q.Limit == 0 || len(entries) < q.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Close closes the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
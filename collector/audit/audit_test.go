@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T) (*Log, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// targets returns the targets of the entries
+func targets(entries []Entry) string {
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Target)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestFind(t *testing.T) {
+	l, cleanup := openLog(t)
+	defer cleanup()
+	start := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	for i, e := range []Entry{
+		{User: "alice", Action: "close-report", Target: "a"},
+		{User: "bob", Action: "reopen-report", Target: "b"},
+		{User: "alice", Action: "purge-report", Target: "c"},
+		{User: "bob", Action: "close-report", Target: "d"},
+		{User: "alice", Action: "close-report", Target: "e"},
+	} {
+		e.Time = start.Add(time.Duration(i) * time.Hour)
+		e.Outcome = OutcomeSuccess
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		query Query
+		want  string
+	}{
+		{"everything", Query{}, "e d c b a"},
+		{"action", Query{Action: "close-report"}, "e d a"},
+		{"user", Query{User: "bob"}, "d b"},
+		{"target", Query{Target: "c"}, "c"},
+		{"since", Query{Since: start.Add(3 * time.Hour)}, "e d"},
+		{"until", Query{Until: start.Add(time.Hour)}, "b a"},
+		{"limit", Query{Limit: 2}, "e d"},
+		{"limit after filtering", Query{User: "alice", Limit: 2}, "e c"},
+		{"no match", Query{User: "carol"}, ""},
+	}
+	for _, tt := range tests {
+		entries, err := l.Find(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := targets(entries); got != tt.want {
+			t.Errorf("%s: found %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindEmpty(t *testing.T) {
+	l, cleanup := openLog(t)
+	defer cleanup()
+	entries, err := l.Find(Query{})
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Find() = %v, %v", entries, err)
+	}
+}
+
+func TestFindMalformed(t *testing.T) {
+	l, cleanup := openLog(t)
+	defer cleanup()
+	l.Record(Entry{Action: "close-report", Target: "a"})
+	l.f.Write([]byte("not json\n"))
+	l.Record(Entry{Action: "close-report", Target: "b"})
+	entries, err := l.Find(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(entries); got != "b a" {
+		t.Errorf("found %q, want %q", got, "b a")
+	}
+}
+
+func TestFindAcrossBlocks(t *testing.T) {
+	l, cleanup := openLog(t)
+	defer cleanup()
+	// Enough entries to span a few blocks, one of them longer than a block
+	var want []string
+	for i := 0; i < 2000; i++ {
+		target := fmt.Sprintf("t%d", i)
+		if i == 1000 {
+			target = strings.Repeat("x", 2*blockSize)
+		}
+		if err := l.Record(Entry{Action: "download-report-file", Target: target}); err != nil {
+			t.Fatal(err)
+		}
+		want = append([]string{target}, want...)
+	}
+	entries, err := l.Find(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(entries); got != strings.Join(want, " ") {
+		t.Errorf("found %d entries, want %d in reverse order", len(entries), len(want))
+	}
+	entries, err = l.Find(Query{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets(entries); got != "t1999 t1998 t1997" {
+		t.Errorf("found %q with a limit", got)
+	}
+}
@@ -0,0 +1,264 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/logging"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "auth",
+	"cmd": "ooni-collector",
+})
+
+// Role is the set of admin actions a user or token is allowed to perform.
+// Every role includes the permissions of the ones below it.
+type Role int
+
+const (
+	// RoleReadOnly can download report files
+	RoleReadOnly Role = iota + 1
+	// RoleOperator can also close, reopen and purge reports and delete files
+	RoleOperator
+	// RoleAdmin can also read the audit log and change the configuration
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "read-only"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// ParseRole parses the name of a role
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "read-only":
+		return RoleReadOnly, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("invalid role %q. Must be one of read-only, operator, admin", name)
+}
+
+// DefaultPassword is the placeholder admin password of the older example
+// configs, refused outside of development mode
+const DefaultPassword = "changeme"
+
+// RoleKey is the gin.Context key holding the Role of the authenticated user
+const RoleKey = "AdminRole"
+
+// UserConfig is an admin user as found in the api.admin-users config
+type UserConfig struct {
+	Name         string `mapstructure:"name"`
+	PasswordHash string `mapstructure:"password-hash"`
+	Role         string `mapstructure:"role"`
+}
+
+// TokenConfig is an API token as found in the api.admin-tokens config
+type TokenConfig struct {
+	Name      string `mapstructure:"name"`
+	TokenHash string `mapstructure:"token-hash"`
+	Role      string `mapstructure:"role"`
+	// Expires is a RFC3339 timestamp, empty means the token never expires
+	Expires string `mapstructure:"expires"`
+}
+
+type user struct {
+	name         string
+	passwordHash []byte
+	// password is only set for the legacy api.admin-password account
+	password string
+	role     Role
+}
+
+type token struct {
+	name    string
+	role    Role
+	expires time.Time
+}
+
+// Authenticator checks the credentials of the admin API requests
+type Authenticator struct {
+	mu     sync.RWMutex
+	users  map[string]*user
+	tokens map[string]*token
+}
+
+// HashToken returns the hex encoded SHA-256 of the token, which is what is
+// stored in the configuration
+func HashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateToken returns a new random API token
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// New creates an authenticator. adminPassword, when not empty, enables the
+// legacy admin account.
+func New(adminPassword string, users []UserConfig, tokens []TokenConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		users:  make(map[string]*user),
+		tokens: make(map[string]*token),
+	}
+	if adminPassword != "" {
+		a.users["admin"] = &user{name: "admin", password: adminPassword, role: RoleAdmin}
+	}
+	for _, u := range users {
+		role, err := ParseRole(u.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin user %q: %v", u.Name, err)
+		}
+		if u.Name == "" {
+			return nil, errors.New("admin user without a name")
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, fmt.Errorf("admin user %q is defined twice", u.Name)
+		}
+		if _, err = bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("admin user %q: invalid bcrypt password-hash", u.Name)
+		}
+		a.users[u.Name] = &user{name: u.Name, passwordHash: []byte(u.PasswordHash), role: role}
+	}
+	for _, t := range tokens {
+		role, err := ParseRole(t.Role)
+		if err != nil {
+			return nil, fmt.Errorf("admin token %q: %v", t.Name, err)
+		}
+		if len(t.TokenHash) != sha256.Size*2 {
+			return nil, fmt.Errorf("admin token %q: invalid token-hash", t.Name)
+		}
+		tok := &token{name: t.Name, role: role}
+		if t.Expires != "" {
+			if tok.expires, err = time.Parse(time.RFC3339, t.Expires); err != nil {
+				return nil, fmt.Errorf("admin token %q: invalid expires", t.Name)
+			}
+		}
+		a.tokens[strings.ToLower(t.TokenHash)] = tok
+	}
+	return a, nil
+}
+
+// Update replaces the users and tokens with the ones of b, ex. after the
+// configuration was reloaded
+func (a *Authenticator) Update(b *Authenticator) {
+	b.mu.RLock()
+	users, tokens := b.users, b.tokens
+	b.mu.RUnlock()
+
+	a.mu.Lock()
+	a.users, a.tokens = users, tokens
+	a.mu.Unlock()
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+func (a *Authenticator) checkPassword(name string, password string) (*user, error) {
+	a.mu.RLock()
+	u, ok := a.users[name]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	if u.passwordHash == nil {
+		if subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) != 1 {
+			return nil, errInvalidCredentials
+		}
+		return u, nil
+	}
+	if bcrypt.CompareHashAndPassword(u.passwordHash, []byte(password)) != nil {
+		return nil, errInvalidCredentials
+	}
+	return u, nil
+}
+
+func (a *Authenticator) checkToken(t string) (*token, error) {
+	a.mu.RLock()
+	tok, ok := a.tokens[HashToken(t)]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	if !tok.expires.IsZero() && time.Now().After(tok.expires) {
+		return nil, errors.New("token expired")
+	}
+	return tok, nil
+}
+
+// authenticate returns the name and role of the requester
+func (a *Authenticator) authenticate(r *http.Request) (string, Role, error) {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		tok, err := a.checkToken(strings.TrimPrefix(header, "Bearer "))
+		if err != nil {
+			return "", 0, err
+		}
+		return "token:" + tok.name, tok.role, nil
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return "", 0, errors.New("missing credentials")
+	}
+	u, err := a.checkPassword(name, password)
+	if err != nil {
+		return "", 0, err
+	}
+	return u.name, u.role, nil
+}
+
+// Require only lets through requests authenticated as a user or token with
+// at least the given role
+func (a *Authenticator) Require(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, granted, err := a.authenticate(c.Request)
+		if err != nil {
+			logging.With(c.Request.Context(), log).WithError(err).Warn("admin authentication failed")
+			c.Header("WWW-Authenticate", `Basic realm="ooni-collector"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "unauthorized",
+			})
+			return
+		}
+		if granted < role {
+			logging.With(c.Request.Context(), log).WithFields(apexLog.Fields{
+				"user":     name,
+				"role":     granted.String(),
+				"required": role.String(),
+			}).Warn("admin authorization failed")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("the %s role is required", role),
+			})
+			return
+		}
+		c.Set(gin.AuthUserKey, name)
+		c.Set(RoleKey, granted)
+		c.Next()
+	}
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hashPassword(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// credentials authenticate a request
+type credentials func(r *http.Request)
+
+func basic(name string, password string) credentials {
+	return func(r *http.Request) { r.SetBasicAuth(name, password) }
+}
+
+func bearer(token string) credentials {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+}
+
+// status returns the status of a request to an endpoint requiring role
+func status(a *Authenticator, role Role, creds credentials) int {
+	router := gin.New()
+	router.GET("/admin", a.Require(role), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(gin.AuthUserKey))
+	})
+	req := httptest.NewRequest("GET", "/admin", nil)
+	if creds != nil {
+		creds(req)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func TestRequire(t *testing.T) {
+	a, err := New("s3cret", []UserConfig{
+		{Name: "alice", PasswordHash: hashPassword(t, "alice-pw"), Role: "operator"},
+		{Name: "bob", PasswordHash: hashPassword(t, "bob-pw"), Role: "read-only"},
+	}, []TokenConfig{
+		{Name: "pipeline", TokenHash: HashToken("valid-token"), Role: "read-only"},
+		{Name: "ops", TokenHash: HashToken("ops-token"), Role: "admin",
+			Expires: time.Now().Add(time.Hour).Format(time.RFC3339)},
+		{Name: "old", TokenHash: HashToken("expired-token"), Role: "admin",
+			Expires: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		role  Role
+		creds credentials
+		want  int
+	}{
+		{"no credentials", RoleReadOnly, nil, http.StatusUnauthorized},
+		{"legacy admin", RoleAdmin, basic("admin", "s3cret"), http.StatusOK},
+		{"legacy admin wrong password", RoleReadOnly, basic("admin", "wrong"), http.StatusUnauthorized},
+		{"operator as operator", RoleOperator, basic("alice", "alice-pw"), http.StatusOK},
+		{"operator as read-only", RoleReadOnly, basic("alice", "alice-pw"), http.StatusOK},
+		{"operator as admin", RoleAdmin, basic("alice", "alice-pw"), http.StatusForbidden},
+		{"read-only as operator", RoleOperator, basic("bob", "bob-pw"), http.StatusForbidden},
+		{"wrong password", RoleReadOnly, basic("alice", "bob-pw"), http.StatusUnauthorized},
+		{"unknown user", RoleReadOnly, basic("carol", "alice-pw"), http.StatusUnauthorized},
+		{"token", RoleReadOnly, bearer("valid-token"), http.StatusOK},
+		{"token with a low role", RoleOperator, bearer("valid-token"), http.StatusForbidden},
+		{"token before expiry", RoleAdmin, bearer("ops-token"), http.StatusOK},
+		{"expired token", RoleReadOnly, bearer("expired-token"), http.StatusUnauthorized},
+		{"unknown token", RoleReadOnly, bearer("unknown-token"), http.StatusUnauthorized},
+		{"token hash as token", RoleReadOnly, bearer(HashToken("valid-token")), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := status(a, tt.role, tt.creds); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoLegacyAdmin(t *testing.T) {
+	a, err := New("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status(a, RoleReadOnly, basic("admin", "")); got != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	hash := hashPassword(t, "pw")
+	tests := []struct {
+		name   string
+		users  []UserConfig
+		tokens []TokenConfig
+	}{
+		{name: "invalid role", users: []UserConfig{{Name: "alice", PasswordHash: hash, Role: "root"}}},
+		{name: "no name", users: []UserConfig{{PasswordHash: hash, Role: "admin"}}},
+		{name: "plain password", users: []UserConfig{{Name: "alice", PasswordHash: "pw", Role: "admin"}}},
+		{
+			name: "duplicate user",
+			users: []UserConfig{
+				{Name: "alice", PasswordHash: hash, Role: "admin"},
+				{Name: "alice", PasswordHash: hash, Role: "read-only"},
+			},
+		},
+		{name: "legacy admin redefined", users: []UserConfig{{Name: "admin", PasswordHash: hash, Role: "admin"}}},
+		{name: "token role", tokens: []TokenConfig{{Name: "t", TokenHash: HashToken("x"), Role: "root"}}},
+		{name: "token hash", tokens: []TokenConfig{{Name: "t", TokenHash: "abc", Role: "admin"}}},
+		{
+			name:   "token expiry",
+			tokens: []TokenConfig{{Name: "t", TokenHash: HashToken("x"), Role: "admin", Expires: "tomorrow"}},
+		},
+	}
+	for _, tt := range tests {
+		if _, err := New("s3cret", tt.users, tt.tokens); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	a, err := New("", []UserConfig{
+		{Name: "alice", PasswordHash: hashPassword(t, "alice-pw"), Role: "admin"},
+	}, []TokenConfig{
+		{Name: "pipeline", TokenHash: HashToken("old-token"), Role: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The configuration is reloaded: alice is demoted, the token rotated
+	// and bob added
+	b, err := New("", []UserConfig{
+		{Name: "alice", PasswordHash: hashPassword(t, "alice-pw"), Role: "read-only"},
+		{Name: "bob", PasswordHash: hashPassword(t, "bob-pw"), Role: "operator"},
+	}, []TokenConfig{
+		{Name: "pipeline", TokenHash: HashToken("new-token"), Role: "admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Update(b)
+
+	tests := []struct {
+		name  string
+		role  Role
+		creds credentials
+		want  int
+	}{
+		{"demoted user", RoleAdmin, basic("alice", "alice-pw"), http.StatusForbidden},
+		{"demoted user keeps the lower role", RoleReadOnly, basic("alice", "alice-pw"), http.StatusOK},
+		{"new user", RoleOperator, basic("bob", "bob-pw"), http.StatusOK},
+		{"old token", RoleReadOnly, bearer("old-token"), http.StatusUnauthorized},
+		{"new token", RoleAdmin, bearer("new-token"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := status(a, tt.role, tt.creds); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	for _, role := range []Role{RoleReadOnly, RoleOperator, RoleAdmin} {
+		parsed, err := ParseRole(role.String())
+		if err != nil || parsed != role {
+			t.Errorf("ParseRole(%q) = %v, %v", role, parsed, err)
+		}
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Error("ParseRole(root) accepted")
+	}
+}
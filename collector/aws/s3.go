@@ -1,11 +1,14 @@
 package aws
 
 import (
+	"context"
 	"os"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
@@ -27,3 +30,14 @@ func UploadFile(sess *session.Session, srcPath string, bucket string, key string
 	log.Debugf("uploaded %s to %s/%s", srcPath, bucket, key)
 	return nil
 }
+
+// CheckBucket verifies that the bucket is reachable with the session
+// credentials
+func CheckBucket(sess *session.Session, bucket string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := s3.New(sess).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	return err
+}
@@ -1,7 +1,9 @@
 package aws
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -33,3 +35,18 @@ func SendMessage(sess *session.Session, body string, groupID string) (*string, e
 
 	return sendResp.MessageId, nil
 }
+
+// CheckQueue verifies that the message queue is reachable with the session
+// credentials
+func CheckQueue(sess *session.Session, timeout time.Duration) error {
+	if sess == nil {
+		return errors.New("invalid aws Session")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := sqs.New(sess).GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameQueueArn)},
+	})
+	return err
+}
@@ -0,0 +1,164 @@
+package certs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "certs",
+	"cmd": "ooni-collector",
+})
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// Reloader serves the certificate loaded from a pair of files and reloads
+// it when they change. Connections that are already established keep the
+// certificate they were started with.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewReloader loads the certificate and key from the given files
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// lastModified returns the most recent modification time of the files
+func (r *Reloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload loads the certificate again. On failure the previous certificate
+// is kept.
+func (r *Reloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	log.WithField("cert-file", r.CertFile).Info("loaded TLS certificate")
+	return nil
+}
+
+// Watch reloads the certificate every interval when the files changed
+func (r *Reloader) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			modTime, err := r.lastModified()
+			if err != nil {
+				log.WithError(err).Error("failed to stat TLS certificate")
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err = r.Reload(); err != nil {
+				log.WithError(err).Error("failed to reload TLS certificate")
+			}
+		}
+	}()
+}
+
+// GetCertificate is the tls.Config.GetCertificate callback
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ParseVersion parses a TLS version, one of 1.0, 1.1, 1.2 or 1.3
+func ParseVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid TLS version %q. Must be one of 1.0, 1.1, 1.2, 1.3", s)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites parses a list of cipher suite names
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	var ids []uint16
+	for _, name := range names {
+		id, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Config returns the TLS configuration serving the reloaded certificate.
+// An empty list of cipher suites keeps the Go defaults.
+func (r *Reloader) Config(minVersion string, suites []string) (*tls.Config, error) {
+	version, err := ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := ParseCipherSuites(suites)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   ids,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
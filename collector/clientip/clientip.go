@@ -0,0 +1,121 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resolver finds the address of the client of a request, trusting the
+// forwarding headers only when they are set by a trusted proxy
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// New creates a resolver trusting the proxies in the given CIDRs. Plain
+// addresses are also accepted.
+func New(cidrs []string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", cidr)
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// Trusted tells whether ip belongs to a trusted proxy
+func (r *Resolver) Trusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromForwardedFor walks X-Forwarded-For from the closest hop and returns
+// the first address that is not a trusted proxy
+func (r *Resolver) fromForwardedFor(header string) net.IP {
+	hops := strings.Split(header, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if i == 0 || !r.Trusted(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// fromViewerAddress parses CloudFront-Viewer-Address, which is the address
+// followed by a colon and the port, without brackets for IPv6
+func fromViewerAddress(header string) net.IP {
+	idx := strings.LastIndex(header, ":")
+	if idx == -1 {
+		return nil
+	}
+	return net.ParseIP(strings.TrimSpace(header[:idx]))
+}
+
+// remoteIP returns the address of the peer of the request, nil over a unix
+// socket
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// FromTrustedProxy tells whether the request was sent by a trusted proxy, so
+// that its forwarding headers can be believed. Requests over a unix socket
+// come from a local proxy and are trusted.
+func (r *Resolver) FromTrustedProxy(req *http.Request) bool {
+	remote := remoteIP(req)
+	return remote == nil || r.Trusted(remote)
+}
+
+// Resolve returns the address of the client of the request
+func (r *Resolver) Resolve(req *http.Request) net.IP {
+	remote := remoteIP(req)
+	if !r.FromTrustedProxy(req) {
+		return remote
+	}
+	if ip := fromViewerAddress(req.Header.Get("CloudFront-Viewer-Address")); ip != nil {
+		return ip
+	}
+	if ip := r.fromForwardedFor(req.Header.Get("X-Forwarded-For")); ip != nil {
+		return ip
+	}
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+// Middleware sets the request RemoteAddr to the resolved client address,
+// so that gin.Context.ClientIP returns it. The router must have
+// ForwardedByClientIP disabled.
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := r.Resolve(c.Request); ip != nil {
+			c.Request.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,189 @@
+package clientip
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNew(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::1", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":      true,
+		"11.0.0.1":      false,
+		"192.0.2.1":     true,
+		"192.0.2.2":     false,
+		"2001:db8::1":   true,
+		"2001:db8::2":   false,
+		"2001:db8:1::5": true,
+	} {
+		if got := r.Trusted(net.ParseIP(ip)); got != want {
+			t.Errorf("Trusted(%s) = %v, want %v", ip, got, want)
+		}
+	}
+	for _, cidr := range []string{"10.0.0.0/33", "not-an-address", "10.0.0/8"} {
+		if _, err = New([]string{cidr}); err == nil {
+			t.Errorf("New(%q) accepted", cidr)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "192.0.2.1:1234", want: "192.0.2.1"},
+		{
+			name:    "untrusted peer sending XFF",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:   "untrusted peer sending every header",
+			remote: "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":           "198.51.100.7",
+				"X-Real-IP":                 "198.51.100.8",
+				"CloudFront-Viewer-Address": "198.51.100.9:443",
+			},
+			want: "192.0.2.1",
+		},
+		{
+			name:    "trusted proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "trusted proxies chain",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7, 10.0.0.3, 10.0.0.2"},
+			want:    "198.51.100.7",
+		},
+		{
+			// The client prepended an address, the first untrusted hop
+			// from the right is the one the trusted proxy saw
+			name:    "spoofed hop",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.1, 198.51.100.7, 10.0.0.2"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "spoofed trusted hop",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.9, 198.51.100.7"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "only trusted hops",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "garbage before the untrusted hop",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "garbage, 198.51.100.7"},
+			want:    "198.51.100.7",
+		},
+		{
+			name:   "garbage hop falls back to X-Real-IP",
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "198.51.100.7, garbage",
+				"X-Real-IP":       "198.51.100.8",
+			},
+			want: "198.51.100.8",
+		},
+		{
+			name:    "garbage hop falls back to the peer",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7, garbage"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:   "cloudfront first",
+			remote: "10.0.0.1:1234",
+			headers: map[string]string{
+				"CloudFront-Viewer-Address": "2001:db8::7:443",
+				"X-Forwarded-For":           "198.51.100.7",
+			},
+			want: "2001:db8::7",
+		},
+		{
+			name:    "X-Real-IP",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Real-IP": "198.51.100.8"},
+			want:    "198.51.100.8",
+		},
+		{name: "trusted proxy without headers", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{
+			name:    "unix socket",
+			remote:  "@",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.7"},
+			want:    "198.51.100.7",
+		},
+		{name: "unix socket without headers", remote: "@", want: "<nil>"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/report", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		if got := r.Resolve(req).String(); got != tt.want {
+			t.Errorf("%s: Resolve() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFromTrustedProxy(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remote, want := range map[string]bool{
+		"10.0.0.1:1234":  true,
+		"192.0.2.1:1234": false,
+		"@":              true,
+	} {
+		req := httptest.NewRequest("POST", "/report", nil)
+		req.RemoteAddr = remote
+		if got := r.FromTrustedProxy(req); got != want {
+			t.Errorf("FromTrustedProxy(%s) = %v, want %v", remote, got, want)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	r, err := New([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clientIP string
+	router := gin.New()
+	router.ForwardedByClientIP = false
+	router.Use(r.Middleware())
+	router.POST("/report", func(c *gin.Context) { clientIP = c.ClientIP() })
+
+	req := httptest.NewRequest("POST", "/report", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if clientIP != "198.51.100.7" {
+		t.Errorf("ClientIP() = %s, want 198.51.100.7", clientIP)
+	}
+}
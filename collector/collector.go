@@ -1,21 +1,38 @@
 package collector
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ooni/collector/collector/api/v1"
+	"github.com/ooni/collector/collector/auth"
 	"github.com/ooni/collector/collector/aws"
+	"github.com/ooni/collector/collector/certs"
+	"github.com/ooni/collector/collector/clientip"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/diskguard"
+	"github.com/ooni/collector/collector/health"
+	"github.com/ooni/collector/collector/info"
+	"github.com/ooni/collector/collector/listener"
+	"github.com/ooni/collector/collector/logging"
 	"github.com/ooni/collector/collector/middleware"
 	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/ratelimit"
 	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/retention"
 	"github.com/ooni/collector/collector/storage"
+	"github.com/ooni/collector/collector/tracing"
+	"github.com/ooni/collector/collector/transport"
 
 	apexLog "github.com/apex/log"
-	"github.com/facebookgo/grace/gracehttp"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
 var log = apexLog.WithFields(apexLog.Fields{
@@ -23,11 +40,11 @@ var log = apexLog.WithFields(apexLog.Fields{
 	"cmd": "ooni-collector",
 })
 
-func initDataRoot() error {
+func initDataRoot(dataRoot string) error {
 	requiredDirs := []string{
-		paths.ReportDir(),
-		paths.TempReportDir(),
-		paths.BadgerDir(),
+		paths.ReportDir(dataRoot),
+		paths.TempReportDir(dataRoot),
+		paths.BadgerDir(dataRoot),
 	}
 	for _, path := range requiredDirs {
 		if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -40,68 +57,268 @@ func initDataRoot() error {
 	return nil
 }
 
-func initAWS() error {
-	accessKeyID := viper.GetString("aws.access-key-id")
-	secretAccessKey := viper.GetString("aws.secret-access-key")
-	if accessKeyID == "" {
+func initAWS(cfg config.AWS) error {
+	if !cfg.Enabled() {
 		return nil
 	}
-	aws.Session = aws.NewSession(accessKeyID, secretAccessKey)
+	aws.Session = aws.NewSession(cfg.AccessKeyID, cfg.SecretAccessKey)
 	return nil
 }
 
-// Start the collector server
-func Start() {
+// sinkCheckInterval is how often the reachability of the sinks is verified
+const sinkCheckInterval = 30 * time.Second
+
+// initHealthChecks registers the checks of the dependencies. s3Bucket holds
+// the name of the bucket, which changes on reload.
+func initHealthChecks(dataRoot string, store *storage.Storage, guard *diskguard.Guard, s3Bucket *atomic.Value) *health.Checker {
+	checker := health.NewChecker()
+	checker.Register("badger", true, store.Ping)
+	checker.Register("report-dir", true, health.DirWritable(paths.ReportDir(dataRoot)))
+	checker.Register("temp-report-dir", true, health.DirWritable(paths.TempReportDir(dataRoot)))
+	checker.Register("disk-guard", true, guard.Err)
+	if aws.Session != nil {
+		checker.Register("s3", false, health.Cached(func() error {
+			return aws.CheckBucket(aws.Session, s3Bucket.Load().(string), 5*time.Second)
+		}, sinkCheckInterval))
+		checker.Register("sqs", false, health.Cached(func() error {
+			return aws.CheckQueue(aws.Session, 5*time.Second)
+		}, sinkCheckInterval))
+	}
+	return checker
+}
+
+// notReadyOnShutdown flips the readiness state as soon as we are asked to
+// shut down, listener.Serve takes care of draining the connections
+func notReadyOnShutdown(checker *health.Checker) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		checker.SetShuttingDown()
+	}()
+}
+
+// reloadOnSIGHUP reloads the configuration and, when serving TLS, the
+// certificate when receiving SIGHUP
+func reloadOnSIGHUP(r *certs.Reloader) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if _, err := config.Reload(); err != nil {
+				log.WithError(err).Error("failed to reload configuration")
+			}
+			if r == nil {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.WithError(err).Error("failed to reload TLS certificate")
+			}
+		}
+	}()
+}
+
+// listenAddrs returns addrs, or address with port when there are none
+func listenAddrs(addrs []string, address string, port int) []string {
+	if len(addrs) > 0 {
+		return addrs
+	}
+	return []string{fmt.Sprintf("%s:%d", address, port)}
+}
+
+// initTLS creates the certificate reloader and the TLS configuration. It
+// returns nil when TLS is disabled.
+func initTLS(cfg config.TLS) (*certs.Reloader, *tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil, nil
+	}
+	r, err := certs.NewReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := r.Config(cfg.MinVersion, cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, tlsConfig, nil
+}
+
+// Start the collector server with the given configuration, as returned
+// by config.Init
+func Start(cfg *config.Config) {
 	var (
 		err error
 	)
-	if viper.GetBool("core.is-dev") != true {
+	if !cfg.Core.IsDev {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	adminPassword := viper.GetString("api.admin-password")
-	if adminPassword == "changeme" {
-		log.Warn("api.admin-password is set to the default value")
+	authn, err := auth.New(cfg.API.AdminPassword, cfg.API.AdminUsers, cfg.API.AdminTokens)
+	if err != nil {
+		log.WithError(err).Error("failed to init admin authentication")
+		return
 	}
+	config.OnReload(func(c *config.Config) {
+		// The new configuration has been validated, so this can't fail
+		if b, err := auth.New(c.API.AdminPassword, c.API.AdminUsers, c.API.AdminTokens); err == nil {
+			authn.Update(b)
+		}
+	})
 
-	if err = initDataRoot(); err != nil {
+	if err = initDataRoot(cfg.Core.DataRoot); err != nil {
 		log.WithError(err).Error("failed to init data root")
 	}
-	if err = initAWS(); err != nil {
+	if err = initAWS(cfg.AWS); err != nil {
 		log.WithError(err).Error("failed to init aws")
 	}
+	shutdownTracing, err := tracing.Init(info.Version, cfg.Tracing)
+	if err != nil {
+		log.WithError(err).Error("failed to init tracing")
+		return
+	}
+	defer shutdownTracing(context.Background())
 
-	store := storage.New(paths.BadgerDir())
+	if err = report.Init(cfg); err != nil {
+		log.WithError(err).Error("failed to init reports")
+		return
+	}
+	store := storage.New(paths.BadgerDir(cfg.Core.DataRoot), cfg.Store)
 	storageMw, err := middleware.InitStorageMiddleware(store)
 	if err != nil {
 		log.WithError(err).Error("failed to init storage middleware")
 		return
 	}
 
-	router := gin.Default()
+	auditMw, err := middleware.InitAuditMiddleware(paths.AuditLog(cfg.Core.DataRoot))
+	if err != nil {
+		log.WithError(err).Error("failed to init audit middleware")
+		return
+	}
+	defer auditMw.AuditLog.Close()
+
+	guard := diskguard.New(cfg.Core.DataRoot,
+		uint64(cfg.DiskGuard.SoftFreeMB)*1024*1024,
+		uint64(cfg.DiskGuard.HardFreeMB)*1024*1024,
+		cfg.DiskGuard.Interval,
+		cfg.DiskGuard.RetryAfter)
+
+	var s3Bucket atomic.Value
+	s3Bucket.Store(cfg.AWS.S3Bucket)
+	checker := initHealthChecks(cfg.Core.DataRoot, store, guard, &s3Bucket)
+	notReadyOnShutdown(checker)
+
+	accessLog := apexLog.WithFields(apexLog.Fields{
+		"pkg": "access",
+		"cmd": "ooni-collector",
+	})
+	resolver, err := clientip.New(cfg.API.TrustedProxies)
+	if err != nil {
+		log.WithError(err).Error("failed to parse api.trusted-proxies")
+		return
+	}
+	router := gin.New()
+	// The client address is resolved by the clientip middleware, which
+	// only trusts the forwarding headers set by the trusted proxies
+	router.ForwardedByClientIP = false
+	router.Use(resolver.Middleware())
+	router.Use(logging.RequestIDMiddleware())
+	router.Use(logging.AccessLogMiddleware(accessLog, cfg.Core.LogRedact))
+	router.Use(logging.RecoveryMiddleware(log))
 	router.Use(storageMw.MiddlewareFunc())
-	err = apiv1.BindAPI(router)
+	router.Use(auditMw.MiddlewareFunc())
+	limits := ratelimit.FromConfig(cfg.RateLimit)
+	err = apiv1.BindAPI(router, cfg.Core.DataRoot, guard, checker, authn, limits)
 	if err != nil {
 		log.WithError(err).Error("failed to BindAPI")
 		return
 	}
+	guard.Start()
+	if limits != nil {
+		limits.Start()
+		defer limits.Stop()
+	}
 	report.ReloadExpiryTimers(store)
+	report.WatchMetadataExpiry(store)
+	sweeper := retention.Start(store, cfg.Core.DataRoot, cfg.Retention)
+	defer sweeper.Stop()
+	config.OnReload(func(c *config.Config) {
+		store.SetConfig(c.Store)
+		report.Configure(c)
+		sweeper.Update(c.Retention)
+		s3Bucket.Store(c.AWS.S3Bucket)
+	})
 
-	Addr := fmt.Sprintf("%s:%d", viper.GetString("api.address"),
-		viper.GetInt("api.port"))
-	log.Infof("starting on %s", Addr)
+	certReloader, tlsConfig, err := initTLS(cfg.API.TLS)
+	if err != nil {
+		log.WithError(err).Error("failed to init TLS")
+		return
+	}
 
-	servers := []*http.Server{
-		&http.Server{
-			Addr:    Addr,
-			Handler: router,
-		},
+	socketMode, err := listener.ParseMode(cfg.API.SocketMode)
+	if err != nil {
+		log.WithError(err).Error("failed to parse api.socket-mode")
+		return
+	}
+
+	var servers []listener.Server
+	if !cfg.API.DisableHTTP {
+		for _, addr := range listenAddrs(cfg.API.Listen, cfg.API.Address, cfg.API.Port) {
+			servers = append(servers, listener.Server{
+				Server: &http.Server{Handler: transport.Handler(router, false, resolver.FromTrustedProxy)},
+				Listen: addr,
+			})
+		}
+	}
+	for _, addr := range cfg.API.OnionListen {
+		servers = append(servers, listener.Server{
+			Server: &http.Server{Handler: transport.Handler(router, true, resolver.FromTrustedProxy)},
+			Listen: addr,
+		})
+	}
+	if tlsConfig != nil {
+		for _, addr := range listenAddrs(cfg.API.TLS.Listen, cfg.API.Address, cfg.API.TLS.Port) {
+			servers = append(servers, listener.Server{
+				Server: &http.Server{
+					Handler:   transport.Handler(router, false, resolver.FromTrustedProxy),
+					TLSConfig: tlsConfig,
+				},
+				Listen: addr,
+			})
+		}
+		certReloader.Watch(cfg.API.TLS.ReloadInterval)
+	}
+	reloadOnSIGHUP(certReloader)
+	if len(servers) == 0 {
+		log.Error("no listener configured, nothing to serve")
+		return
+	}
+	proxied := make(map[string]bool)
+	for _, addr := range cfg.API.ProxyProtocol {
+		proxied[addr] = true
 	}
-	opt := gracehttp.PreStartProcess(func() error {
-		return store.Close()
+	for i := range servers {
+		servers[i].ProxyProtocol = proxied[servers[i].Listen]
+	}
+	err = listener.Serve(servers, listener.Options{
+		PreStartProcess: func() error {
+			checker.SetShuttingDown()
+			return store.Close()
+		},
+		StartProcessFailed: func() error {
+			if err := store.Init(); err != nil {
+				return err
+			}
+			checker.SetServing()
+			return nil
+		},
+		SocketMode: socketMode,
+		Trusted:    resolver.Trusted,
 	})
-	err = gracehttp.ServeWithOptions(servers, opt)
 	if err != nil {
 		log.WithError(err).Error("failed to start server")
 	}
+	report.CloseFiles()
+	if err = store.Close(); err != nil {
+		log.WithError(err).Error("failed to close the store")
+	}
 }
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/ooni/collector/collector/auth"
+	"github.com/spf13/viper"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "config",
+	"cmd": "ooni-collector",
+})
+
+// Config is the configuration of the collector, as read from the
+// configuration file, the environment and the command line flags
+type Config struct {
+	Core       Core       `mapstructure:"core"`
+	API        API        `mapstructure:"api"`
+	AWS        AWS        `mapstructure:"aws"`
+	DiskGuard  DiskGuard  `mapstructure:"disk-guard"`
+	Retention  Retention  `mapstructure:"retention"`
+	Tracing    Tracing    `mapstructure:"tracing"`
+	RateLimit  RateLimit  `mapstructure:"rate-limit"`
+	Store      Store      `mapstructure:"store"`
+	Durability Durability `mapstructure:"durability"`
+}
+
+// Core is the [core] section
+type Core struct {
+	LogLevel     string        `mapstructure:"log-level"`
+	LogFormat    string        `mapstructure:"log-format"`
+	LogRedact    []string      `mapstructure:"log-redact"`
+	DataRoot     string        `mapstructure:"data-root"`
+	IsDev        bool          `mapstructure:"is-dev"`
+	ReportExpiry time.Duration `mapstructure:"report-expiry"`
+	// ReportFileCache is the number of report files kept open
+	ReportFileCache int `mapstructure:"report-file-cache"`
+}
+
+// API is the [api] section
+type API struct {
+	Address        string             `mapstructure:"address"`
+	Port           int                `mapstructure:"port"`
+	Listen         []string           `mapstructure:"listen"`
+	SocketMode     string             `mapstructure:"socket-mode"`
+	OnionListen    []string           `mapstructure:"onion-listen"`
+	DisableHTTP    bool               `mapstructure:"disable-http"`
+	TrustedProxies []string           `mapstructure:"trusted-proxies"`
+	ProxyProtocol  []string           `mapstructure:"proxy-protocol"`
+	FQN            string             `mapstructure:"fqn"`
+	AdminPassword  string             `mapstructure:"admin-password"`
+	AdminUsers     []auth.UserConfig  `mapstructure:"admin-users"`
+	AdminTokens    []auth.TokenConfig `mapstructure:"admin-tokens"`
+	TLS            TLS                `mapstructure:"tls"`
+}
+
+// TLS is the [api.tls] section
+type TLS struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	Port           int           `mapstructure:"port"`
+	Listen         []string      `mapstructure:"listen"`
+	CertFile       string        `mapstructure:"cert-file"`
+	KeyFile        string        `mapstructure:"key-file"`
+	MinVersion     string        `mapstructure:"min-version"`
+	CipherSuites   []string      `mapstructure:"cipher-suites"`
+	ReloadInterval time.Duration `mapstructure:"reload-interval"`
+}
+
+// AWS is the [aws] section
+type AWS struct {
+	AccessKeyID     string `mapstructure:"access-key-id"`
+	SecretAccessKey string `mapstructure:"secret-access-key"`
+	S3Bucket        string `mapstructure:"s3-bucket"`
+	S3Prefix        string `mapstructure:"s3-prefix"`
+}
+
+// Enabled tells whether the closed reports are shipped to S3 and SQS
+func (a AWS) Enabled() bool {
+	return a.AccessKeyID != ""
+}
+
+// DiskGuard is the [disk-guard] section
+type DiskGuard struct {
+	SoftFreeMB int64         `mapstructure:"soft-free-mb"`
+	HardFreeMB int64         `mapstructure:"hard-free-mb"`
+	Interval   time.Duration `mapstructure:"interval"`
+	RetryAfter time.Duration `mapstructure:"retry-after"`
+}
+
+// Retention is the [retention] section
+type Retention struct {
+	Enabled           bool          `mapstructure:"enabled"`
+	DryRun            bool          `mapstructure:"dry-run"`
+	Interval          time.Duration `mapstructure:"interval"`
+	DeleteAfterUpload bool          `mapstructure:"delete-after-upload"`
+	MaxAgeDays        int           `mapstructure:"max-age-days"`
+	MaxDiskUsage      float64       `mapstructure:"max-disk-usage"`
+	// DeleteNotUploaded lets MaxDiskUsage delete the files not uploaded yet
+	DeleteNotUploaded bool `mapstructure:"delete-not-uploaded"`
+}
+
+// Store is the [store] section
+type Store struct {
+	OpenMetadataTTL   time.Duration `mapstructure:"open-metadata-ttl"`
+	ClosedMetadataTTL time.Duration `mapstructure:"closed-metadata-ttl"`
+	TombstoneTTL      time.Duration `mapstructure:"tombstone-ttl"`
+	ExpiryNotice      time.Duration `mapstructure:"expiry-notice"`
+}
+
+// Durability is the [durability] section
+type Durability struct {
+	Policy              string        `mapstructure:"policy"`
+	GroupCommitInterval time.Duration `mapstructure:"group-commit-interval"`
+}
+
+// Tracing is the [tracing] section
+type Tracing struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	ServiceName string  `mapstructure:"service-name"`
+	SampleRatio float64 `mapstructure:"sample-ratio"`
+}
+
+// RateLimit is the [rate-limit] section
+type RateLimit struct {
+	Enabled bool        `mapstructure:"enabled"`
+	Create  RateBudgets `mapstructure:"create"`
+	Submit  RateBudgets `mapstructure:"submit"`
+}
+
+// RateBudgets are the budgets of a kind of request
+type RateBudgets struct {
+	IP     RateBudget `mapstructure:"ip"`
+	ASN    RateBudget `mapstructure:"asn"`
+	Global RateBudget `mapstructure:"global"`
+}
+
+// RateBudget is a token bucket, Rate is in requests per minute
+type RateBudget struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// Load reads the configuration from v and validates it
+func Load(v *viper.Viper) (*Config, error) {
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+var (
+	current atomic.Value
+	// lastGood is the content of the configuration file that was last
+	// loaded successfully
+	lastGood []byte
+	// running are the settings of the current configuration, by dotted key
+	running map[string]interface{}
+)
+
+// Init loads the configuration from the global viper and makes it the
+// current one. It must be called once the configuration file has been read.
+func Init() (*Config, error) {
+	c, err := Load(viper.GetViper())
+	if err != nil {
+		return nil, err
+	}
+	if path := viper.ConfigFileUsed(); path != "" {
+		if lastGood, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	running = allSettings()
+	current.Store(c)
+	return c, nil
+}
+
+// Current returns the configuration in use, or nil before Init. Once
+// published a Config is never modified, a reload publishes a new one.
+func Current() *Config {
+	c, _ := current.Load().(*Config)
+	return c
+}
+
+// File returns the path of the configuration file in use, if any
+func File() string {
+	return viper.ConfigFileUsed()
+}
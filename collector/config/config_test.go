@@ -0,0 +1,37 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestExampleConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := viper.New()
+	SetDefaults(v)
+	v.SetConfigFile("../../ooni-collector.toml")
+	if err = v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	v.Set("core.data-root", dir)
+	if _, err = Load(v); err != nil {
+		t.Errorf("the example configuration is invalid: %v", err)
+	}
+}
+
+func TestCurrentBeforeInit(t *testing.T) {
+	if c := Current(); c != nil {
+		t.Errorf("Current() = %v before Init", c)
+	}
+	if _, err := Reload(); err == nil {
+		t.Error("Reload() before Init succeeded")
+	}
+}
@@ -0,0 +1,72 @@
+package config
+
+import "github.com/spf13/viper"
+
+// SetDefaults sets the default value of every setting on v. The command
+// line flags bound to settings use the same defaults.
+func SetDefaults(v *viper.Viper) {
+	v.SetDefault("core.log-level", "info")
+	v.SetDefault("core.log-format", "text")
+	v.SetDefault("core.log-redact", []string{"client_ip"})
+	v.SetDefault("core.data-root", "/var/ooni-collector")
+	v.SetDefault("core.is-dev", false)
+	v.SetDefault("core.report-expiry", "8h")
+	v.SetDefault("core.report-file-cache", 256)
+	v.SetDefault("api.address", "127.0.0.1")
+	v.SetDefault("api.port", 8080)
+	v.SetDefault("api.admin-password", "")
+	v.SetDefault("api.fqn", "unknown")
+	v.SetDefault("api.listen", []string{})
+	v.SetDefault("api.socket-mode", "0660")
+	v.SetDefault("api.onion-listen", []string{})
+	v.SetDefault("api.trusted-proxies", []string{})
+	v.SetDefault("api.proxy-protocol", []string{})
+	v.SetDefault("api.disable-http", false)
+	v.SetDefault("api.tls.enabled", false)
+	v.SetDefault("api.tls.port", 8443)
+	v.SetDefault("api.tls.listen", []string{})
+	v.SetDefault("api.tls.cert-file", "")
+	v.SetDefault("api.tls.key-file", "")
+	v.SetDefault("api.tls.min-version", "1.2")
+	v.SetDefault("api.tls.cipher-suites", []string{})
+	v.SetDefault("api.tls.reload-interval", "1m")
+	v.SetDefault("aws.access-key-id", "")
+	v.SetDefault("aws.secret-access-key", "")
+	v.SetDefault("aws.s3-bucket", "ooni-collector")
+	v.SetDefault("aws.s3-prefix", "reports")
+	v.SetDefault("disk-guard.soft-free-mb", 1024)
+	v.SetDefault("disk-guard.hard-free-mb", 256)
+	v.SetDefault("disk-guard.interval", "10s")
+	v.SetDefault("disk-guard.retry-after", "5m")
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "localhost:4318")
+	v.SetDefault("tracing.insecure", true)
+	v.SetDefault("tracing.service-name", "ooni-collector")
+	v.SetDefault("tracing.sample-ratio", 1.0)
+	v.SetDefault("retention.enabled", false)
+	v.SetDefault("retention.dry-run", false)
+	v.SetDefault("retention.interval", "1h")
+	v.SetDefault("retention.delete-after-upload", false)
+	v.SetDefault("retention.max-age-days", 0)
+	v.SetDefault("retention.max-disk-usage", 0)
+	v.SetDefault("retention.delete-not-uploaded", false)
+	v.SetDefault("store.open-metadata-ttl", "720h")
+	v.SetDefault("store.closed-metadata-ttl", "2160h")
+	v.SetDefault("store.tombstone-ttl", "8760h")
+	v.SetDefault("store.expiry-notice", "24h")
+	v.SetDefault("durability.policy", "none")
+	v.SetDefault("durability.group-commit-interval", "5ms")
+	v.SetDefault("rate-limit.enabled", false)
+	v.SetDefault("rate-limit.create.ip.rate", 60)
+	v.SetDefault("rate-limit.create.ip.burst", 30)
+	v.SetDefault("rate-limit.create.asn.rate", 600)
+	v.SetDefault("rate-limit.create.asn.burst", 300)
+	v.SetDefault("rate-limit.create.global.rate", 6000)
+	v.SetDefault("rate-limit.create.global.burst", 1000)
+	v.SetDefault("rate-limit.submit.ip.rate", 600)
+	v.SetDefault("rate-limit.submit.ip.burst", 300)
+	v.SetDefault("rate-limit.submit.asn.rate", 6000)
+	v.SetDefault("rate-limit.submit.asn.burst", 3000)
+	v.SetDefault("rate-limit.submit.global.rate", 60000)
+	v.SetDefault("rate-limit.submit.global.burst", 10000)
+}
@@ -0,0 +1,221 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	apexLog "github.com/apex/log"
+	"github.com/spf13/viper"
+)
+
+// reloadableKeys are the keys applied by Reload. The subsystems apply them
+// from the OnReload hooks, ex. the retention policy at the next sweep and
+// the store settings at the next write.
+var reloadableKeys = map[string]bool{
+	"core.log-level":                true,
+	"api.admin-password":            true,
+	"api.admin-users":               true,
+	"api.admin-tokens":              true,
+	"aws.s3-bucket":                 true,
+	"aws.s3-prefix":                 true,
+	"core.report-expiry":            true,
+	"retention.dry-run":             true,
+	"retention.delete-after-upload": true,
+	"retention.max-age-days":        true,
+	"retention.max-disk-usage":      true,
+	"retention.delete-not-uploaded": true,
+	"store.open-metadata-ttl":       true,
+	"store.closed-metadata-ttl":     true,
+	"store.tombstone-ttl":           true,
+	"store.expiry-notice":           true,
+}
+
+// secretKeys are the keys whose values are never logged
+var secretKeys = map[string]bool{
+	"api.admin-password":    true,
+	"api.admin-users":       true,
+	"api.admin-tokens":      true,
+	"aws.access-key-id":     true,
+	"aws.secret-access-key": true,
+}
+
+// Redact hides the value of the secret settings
+func Redact(key string, value interface{}) interface{} {
+	if secretKeys[key] {
+		return "redacted"
+	}
+	return value
+}
+
+var (
+	// reloadMu serializes the reloads
+	reloadMu sync.Mutex
+	hooks    []func(*Config)
+)
+
+// OnReload registers a function called with the new configuration after
+// every successful reload
+func OnReload(hook func(*Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	hooks = append(hooks, hook)
+}
+
+// Change is a setting whose value changed on reload
+type Change struct {
+	Key string      `json:"key"`
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// Result is the outcome of a reload
+type Result struct {
+	// Applied are the changes that took effect
+	Applied []Change `json:"applied"`
+	// RestartRequired are the settings of the file, changed by this reload
+	// or a previous one, that differ from the running value and need a
+	// restart to take effect
+	RestartRequired []Change `json:"restart_required"`
+}
+
+// Flatten turns the nested settings into a map of dotted keys
+func Flatten(prefix string, settings map[string]interface{}, out map[string]interface{}) {
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			Flatten(prefix+key+".", nested, out)
+			continue
+		}
+		out[prefix+key] = value
+	}
+}
+
+func allSettings() map[string]interface{} {
+	out := make(map[string]interface{})
+	Flatten("", viper.AllSettings(), out)
+	return out
+}
+
+func restoreLastGood() {
+	if err := viper.ReadConfig(bytes.NewReader(lastGood)); err != nil {
+		log.WithError(err).Error("failed to restore the previous configuration")
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadSettings loads the configuration from the flattened settings
+func loadSettings(settings map[string]interface{}) (*Config, error) {
+	v := viper.New()
+	for key, value := range settings {
+		v.Set(key, value)
+	}
+	return Load(v)
+}
+
+// Reload reads the configuration file again and, if it's valid, publishes
+// the new configuration. The settings that can't change at runtime keep
+// the value the collector is running with, their changes are reported in
+// Result.RestartRequired until the file agrees with the running value.
+func Reload() (*Result, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if Current() == nil {
+		return nil, errors.New("the configuration has not been initialized")
+	}
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil, errors.New("no configuration file in use")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	viper.SetConfigType(strings.TrimPrefix(filepath.Ext(path), "."))
+	if err = viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		restoreLastGood()
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if _, err = Load(viper.GetViper()); err != nil {
+		restoreLastGood()
+		return nil, err
+	}
+	file := allSettings()
+
+	keys := make(map[string]bool)
+	for key := range running {
+		keys[key] = true
+	}
+	for key := range file {
+		keys[key] = true
+	}
+
+	result := &Result{
+		Applied:         []Change{},
+		RestartRequired: []Change{},
+	}
+	// next are the settings of the new configuration: the reloadable ones
+	// from the file, the others from the running configuration
+	next := make(map[string]interface{})
+	for _, key := range sortedKeys(keys) {
+		if !reloadableKeys[key] {
+			if value, ok := running[key]; ok {
+				next[key] = value
+			}
+		} else if value, ok := file[key]; ok {
+			next[key] = value
+		}
+		if reflect.DeepEqual(running[key], file[key]) {
+			continue
+		}
+		change := Change{
+			Key: key,
+			Old: Redact(key, running[key]),
+			New: Redact(key, file[key]),
+		}
+		ctx := log.WithFields(apexLog.Fields{
+			"key": key,
+			"old": change.Old,
+			"new": change.New,
+		})
+		if reloadableKeys[key] {
+			ctx.Info("setting changed")
+			result.Applied = append(result.Applied, change)
+			continue
+		}
+		ctx.Warn("setting changed, restart required")
+		result.RestartRequired = append(result.RestartRequired, change)
+	}
+
+	c, err := loadSettings(next)
+	if err != nil {
+		restoreLastGood()
+		return nil, err
+	}
+	lastGood = data
+	running = next
+	current.Store(c)
+	if level, err := apexLog.ParseLevel(c.Core.LogLevel); err == nil {
+		apexLog.SetLevel(level)
+	}
+	for _, hook := range hooks {
+		hook(c)
+	}
+	log.Infof("reloaded configuration from %s", path)
+	return result, nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// writeConfig writes a configuration file with the port and report expiry
+func writeConfig(t *testing.T, path string, dataRoot string, port int, expiry string) {
+	data := fmt.Sprintf(`[core]
+data-root = %q
+is-dev = true
+report-expiry = %q
+
+[api]
+port = %d
+`, dataRoot, expiry, port)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changedKeys returns the keys of the changes
+func changedKeys(changes []Change) []string {
+	keys := []string{}
+	for _, c := range changes {
+		keys = append(keys, c.Key)
+	}
+	return keys
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ooni-collector.toml")
+	writeConfig(t, path, dir, 8080, "8h")
+
+	viper.Reset()
+	defer viper.Reset()
+	SetDefaults(viper.GetViper())
+	viper.SetConfigFile(path)
+	if err = viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Init(); err != nil {
+		t.Fatal(err)
+	}
+	var hooked *Config
+	OnReload(func(c *Config) { hooked = c })
+
+	// The port needs a restart, the report expiry is applied
+	writeConfig(t, path, dir, 8081, "2h")
+	result, err := Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := fmt.Sprint(changedKeys(result.Applied)); keys != "[core.report-expiry]" {
+		t.Errorf("applied %s", keys)
+	}
+	if keys := fmt.Sprint(changedKeys(result.RestartRequired)); keys != "[api.port]" {
+		t.Errorf("restart required for %s", keys)
+	}
+	c := Current()
+	if c.API.Port != 8080 || c.Core.ReportExpiry != 2*time.Hour {
+		t.Errorf("running with port %d and expiry %s", c.API.Port, c.Core.ReportExpiry)
+	}
+	if hooked != c {
+		t.Error("the hook was not called with the new configuration")
+	}
+	// The file is not shadowed by the running value
+	if port := viper.GetInt("api.port"); port != 8081 {
+		t.Errorf("api.port = %d in viper, want the value of the file", port)
+	}
+
+	// The change waits for a restart until it's reverted
+	writeConfig(t, path, dir, 8081, "2h")
+	if result, err = Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.RestartRequired) != 1 {
+		t.Errorf("unchanged file: applied %v, restart required %v", result.Applied, result.RestartRequired)
+	}
+	writeConfig(t, path, dir, 8080, "2h")
+	if result, err = Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.RestartRequired) != 0 {
+		t.Errorf("reverted file: applied %v, restart required %v", result.Applied, result.RestartRequired)
+	}
+
+	// An invalid file is refused and the configuration kept
+	c = Current()
+	writeConfig(t, path, dir, 8080, "-1h")
+	if _, err = Reload(); err == nil {
+		t.Error("invalid configuration reloaded")
+	}
+	if Current() != c {
+		t.Error("the configuration changed on a failed reload")
+	}
+	if expiry := viper.GetString("core.report-expiry"); expiry != "2h" {
+		t.Errorf("core.report-expiry = %s in viper after a failed reload", expiry)
+	}
+}
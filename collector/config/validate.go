@@ -0,0 +1,207 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/ooni/collector/collector/auth"
+	"github.com/ooni/collector/collector/certs"
+	"github.com/ooni/collector/collector/clientip"
+	"github.com/ooni/collector/collector/durability"
+	"github.com/ooni/collector/collector/listener"
+)
+
+// ValidationError lists all the problems found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) check(key string, err error) {
+	if err != nil {
+		v.addf("%s: %v", key, err)
+	}
+}
+
+func (v *validator) port(key string, port int) {
+	if port < 1 || port > 65535 {
+		v.addf("%s: %d is not a valid port", key, port)
+	}
+}
+
+func (v *validator) listen(key string, addrs []string) {
+	for _, addr := range addrs {
+		_, _, err := listener.Parse(addr)
+		v.check(key, err)
+	}
+}
+
+func (v *validator) file(key string, path string) {
+	if path == "" {
+		v.addf("%s is required", key)
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.check(key, err)
+	}
+}
+
+func (v *validator) budget(key string, b RateBudget) {
+	if b.Rate < 0 || b.Burst < 0 {
+		v.addf("%s: rate and burst must not be negative", key)
+	}
+	if b.Rate > 0 && b.Burst == 0 {
+		v.addf("%s: burst must be at least 1", key)
+	}
+}
+
+// writableDir checks that path is a directory the collector can write to
+func writableDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	f, err := ioutil.TempFile(path, ".write-check")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", path)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Validate checks the configuration, reporting all the problems at once
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	if _, err := apexLog.ParseLevel(c.Core.LogLevel); err != nil {
+		v.addf("core.log-level: invalid level %q", c.Core.LogLevel)
+	}
+	switch c.Core.LogFormat {
+	case "", "text", "json", "logfmt":
+	default:
+		v.addf("core.log-format: must be one of text, json, logfmt")
+	}
+	v.check("core.data-root", writableDir(c.Core.DataRoot))
+	if c.Core.ReportExpiry <= 0 {
+		v.addf("core.report-expiry: must be a positive duration")
+	}
+	if c.Core.ReportFileCache < 0 {
+		v.addf("core.report-file-cache: must not be negative")
+	}
+
+	if len(c.API.Listen) == 0 {
+		v.port("api.port", c.API.Port)
+	}
+	v.listen("api.listen", c.API.Listen)
+	v.listen("api.onion-listen", c.API.OnionListen)
+	_, err := listener.ParseMode(c.API.SocketMode)
+	v.check("api.socket-mode", err)
+	_, err = clientip.New(c.API.TrustedProxies)
+	v.check("api.trusted-proxies", err)
+	if c.API.AdminPassword == auth.DefaultPassword && !c.Core.IsDev {
+		v.addf("api.admin-password: set to the placeholder %q, change it or remove it", auth.DefaultPassword)
+	}
+	_, err = auth.New(c.API.AdminPassword, c.API.AdminUsers, c.API.AdminTokens)
+	v.check("api", err)
+
+	if c.API.TLS.Enabled {
+		if len(c.API.TLS.Listen) == 0 {
+			v.port("api.tls.port", c.API.TLS.Port)
+		}
+		v.listen("api.tls.listen", c.API.TLS.Listen)
+		v.file("api.tls.cert-file", c.API.TLS.CertFile)
+		v.file("api.tls.key-file", c.API.TLS.KeyFile)
+		_, err = certs.ParseVersion(c.API.TLS.MinVersion)
+		v.check("api.tls.min-version", err)
+		_, err = certs.ParseCipherSuites(c.API.TLS.CipherSuites)
+		v.check("api.tls.cipher-suites", err)
+		if c.API.TLS.ReloadInterval <= 0 {
+			v.addf("api.tls.reload-interval: must be a positive duration")
+		}
+	} else if c.API.DisableHTTP && len(c.API.OnionListen) == 0 {
+		v.addf("api.disable-http: no listener left, enable api.tls or api.onion-listen")
+	}
+
+	if c.AWS.Enabled() {
+		if c.AWS.SecretAccessKey == "" {
+			v.addf("aws.secret-access-key is required when aws.access-key-id is set")
+		}
+		if c.AWS.S3Bucket == "" {
+			v.addf("aws.s3-bucket is required when aws.access-key-id is set")
+		}
+	}
+
+	if c.DiskGuard.HardFreeMB > c.DiskGuard.SoftFreeMB {
+		v.addf("disk-guard.hard-free-mb: must not be larger than soft-free-mb")
+	}
+	if c.DiskGuard.Interval <= 0 {
+		v.addf("disk-guard.interval: must be a positive duration")
+	}
+
+	if c.Retention.Enabled && c.Retention.Interval <= 0 {
+		v.addf("retention.interval: must be a positive duration")
+	}
+	if c.Retention.MaxAgeDays < 0 {
+		v.addf("retention.max-age-days: must not be negative")
+	}
+	if c.Retention.MaxDiskUsage < 0 || c.Retention.MaxDiskUsage > 100 {
+		v.addf("retention.max-disk-usage: must be a percentage")
+	}
+
+	if c.Store.OpenMetadataTTL <= 0 {
+		v.addf("store.open-metadata-ttl: must be a positive duration")
+	} else if c.Store.OpenMetadataTTL <= c.Core.ReportExpiry {
+		v.addf("store.open-metadata-ttl: must be longer than core.report-expiry")
+	}
+	if c.Store.ClosedMetadataTTL <= 0 {
+		v.addf("store.closed-metadata-ttl: must be a positive duration")
+	}
+	if c.Store.TombstoneTTL < 0 {
+		v.addf("store.tombstone-ttl: must not be negative")
+	}
+	if c.Store.ExpiryNotice <= 0 {
+		v.addf("store.expiry-notice: must be a positive duration")
+	}
+
+	policy, err := durability.ParsePolicy(c.Durability.Policy)
+	v.check("durability.policy", err)
+	if policy == durability.Group && c.Durability.GroupCommitInterval <= 0 {
+		v.addf("durability.group-commit-interval: must be a positive duration")
+	}
+
+	if c.Tracing.Enabled && c.Tracing.Endpoint == "" {
+		v.addf("tracing.endpoint is required when tracing is enabled")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		v.addf("tracing.sample-ratio: must be between 0 and 1")
+	}
+
+	v.budget("rate-limit.create.ip", c.RateLimit.Create.IP)
+	v.budget("rate-limit.create.asn", c.RateLimit.Create.ASN)
+	v.budget("rate-limit.create.global", c.RateLimit.Create.Global)
+	v.budget("rate-limit.submit.ip", c.RateLimit.Submit.IP)
+	v.budget("rate-limit.submit.asn", c.RateLimit.Submit.ASN)
+	v.budget("rate-limit.submit.global", c.RateLimit.Submit.Global)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package diskguard
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/metrics"
+	"github.com/ooni/collector/collector/util"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "diskguard",
+	"cmd": "ooni-collector",
+})
+
+// diskUsage measures the filesystem of the guarded path, the tests replace it
+var diskUsage = util.DiskUsage
+
+// State is the state of the free space on the data root
+type State int
+
+const (
+	// StateOK means there is enough free space
+	StateOK State = iota
+	// StateSoft means the free space went below the soft threshold and
+	// measurement submissions are being refused
+	StateSoft
+	// StateHard means the free space went below the hard threshold and
+	// new reports are being refused as well
+	StateHard
+)
+
+func (s State) String() string {
+	switch s {
+	case StateSoft:
+		return "soft"
+	case StateHard:
+		return "hard"
+	}
+	return "ok"
+}
+
+// Guard monitors the free space on the filesystem holding the data root
+type Guard struct {
+	Path       string
+	SoftFree   uint64
+	HardFree   uint64
+	Interval   time.Duration
+	RetryAfter time.Duration
+
+	mu    sync.RWMutex
+	state State
+	total uint64
+	avail uint64
+}
+
+// New creates a guard for path. softFree and hardFree are the amount of free
+// bytes below which the guard enters the soft and hard state.
+func New(path string, softFree uint64, hardFree uint64, interval time.Duration, retryAfter time.Duration) *Guard {
+	return &Guard{
+		Path:       path,
+		SoftFree:   softFree,
+		HardFree:   hardFree,
+		Interval:   interval,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Check measures the free space and updates the state of the guard
+func (g *Guard) Check() error {
+	total, avail, err := diskUsage(g.Path)
+	if err != nil {
+		log.WithError(err).Error("failed to measure free space")
+		return err
+	}
+	state := StateOK
+	if avail < g.HardFree {
+		state = StateHard
+	} else if avail < g.SoftFree {
+		state = StateSoft
+	}
+
+	g.mu.Lock()
+	previous := g.state
+	g.state, g.total, g.avail = state, total, avail
+	g.mu.Unlock()
+
+	if state != previous {
+		log.WithFields(apexLog.Fields{
+			"from":            previous.String(),
+			"to":              state.String(),
+			"available_bytes": avail,
+		}).Warn("disk guard state changed")
+	}
+	metrics.DiskAvailable.Set(float64(avail))
+	metrics.DiskGuardState.Set(float64(state))
+	return nil
+}
+
+// Start checks the free space right away and then every Interval
+func (g *Guard) Start() {
+	g.Check()
+	go func() {
+		ticker := time.NewTicker(g.Interval)
+		for range ticker.C {
+			g.Check()
+		}
+	}()
+}
+
+// State returns the last measured state
+func (g *Guard) State() State {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.state
+}
+
+// ErrLowDiskSpace indicates the free space is below the soft threshold
+var ErrLowDiskSpace = errors.New("low disk space")
+
+// Err describes the threshold that was reached unless the guard is in the
+// ok state
+func (g *Guard) Err() error {
+	if state := g.State(); state != StateOK {
+		return fmt.Errorf("%s: %s threshold reached", ErrLowDiskSpace, state)
+	}
+	return nil
+}
+
+func (g *Guard) refuse(c *gin.Context) {
+	c.Header("Retry-After", fmt.Sprintf("%d", int(g.RetryAfter.Seconds())))
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error": "insufficient disk space, retry later",
+	})
+}
+
+// SubmissionMiddleware refuses measurement submissions when the free space
+// is below the soft threshold
+func (g *Guard) SubmissionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.State() >= StateSoft {
+			g.refuse(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// NewReportMiddleware refuses the creation of new reports when the free
+// space is below the hard threshold
+func (g *Guard) NewReportMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.State() >= StateHard {
+			g.refuse(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// HealthHandler exposes the state of the guard
+func (g *Guard) HealthHandler(c *gin.Context) {
+	g.mu.RLock()
+	state, total, avail := g.state, g.total, g.avail
+	g.mu.RUnlock()
+
+	status := http.StatusOK
+	if state != StateOK {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"state":                state.String(),
+		"total_bytes":          total,
+		"available_bytes":      avail,
+		"soft_threshold_bytes": g.SoftFree,
+		"hard_threshold_bytes": g.HardFree,
+	})
+}
@@ -0,0 +1,97 @@
+package diskguard
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setAvailable makes the guarded filesystem have avail free bytes out of 100
+func setAvailable(avail uint64) {
+	diskUsage = func(path string) (uint64, uint64, error) {
+		return 100, avail, nil
+	}
+}
+
+// status returns the statuses of a submission, a new report and the health
+// endpoint
+func status(t *testing.T, g *Guard) (int, int, int) {
+	router := gin.New()
+	router.POST("/report/:reportID", g.SubmissionMiddleware(), func(c *gin.Context) {})
+	router.POST("/report", g.NewReportMiddleware(), func(c *gin.Context) {})
+	router.GET("/health", g.HealthHandler)
+	var codes []int
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/report/1", nil),
+		httptest.NewRequest("POST", "/report", nil),
+		httptest.NewRequest("GET", "/health", nil),
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code == http.StatusServiceUnavailable && req.Method == "POST" && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("%s %s refused with Retry-After %q", req.Method, req.URL, w.Header().Get("Retry-After"))
+		}
+		codes = append(codes, w.Code)
+	}
+	return codes[0], codes[1], codes[2]
+}
+
+func TestCheck(t *testing.T) {
+	defer func(f func(string) (uint64, uint64, error)) { diskUsage = f }(diskUsage)
+	g := New("/data", 20, 10, time.Minute, time.Minute)
+	tests := []struct {
+		avail      uint64
+		state      State
+		submission int
+		newReport  int
+		health     int
+	}{
+		{50, StateOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		{20, StateOK, http.StatusOK, http.StatusOK, http.StatusOK},
+		{19, StateSoft, http.StatusServiceUnavailable, http.StatusOK, http.StatusServiceUnavailable},
+		{10, StateSoft, http.StatusServiceUnavailable, http.StatusOK, http.StatusServiceUnavailable},
+		{9, StateHard, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{15, StateSoft, http.StatusServiceUnavailable, http.StatusOK, http.StatusServiceUnavailable},
+		{30, StateOK, http.StatusOK, http.StatusOK, http.StatusOK},
+	}
+	for _, tt := range tests {
+		setAvailable(tt.avail)
+		if err := g.Check(); err != nil {
+			t.Fatal(err)
+		}
+		if state := g.State(); state != tt.state {
+			t.Errorf("%d available: state %s, want %s", tt.avail, state, tt.state)
+		}
+		if err := g.Err(); (err != nil) != (tt.state != StateOK) {
+			t.Errorf("%d available: Err() = %v", tt.avail, err)
+		}
+		submission, newReport, health := status(t, g)
+		if submission != tt.submission || newReport != tt.newReport || health != tt.health {
+			t.Errorf("%d available: submission %d, new report %d, health %d, want %d, %d, %d",
+				tt.avail, submission, newReport, health, tt.submission, tt.newReport, tt.health)
+		}
+	}
+}
+
+func TestCheckError(t *testing.T) {
+	defer func(f func(string) (uint64, uint64, error)) { diskUsage = f }(diskUsage)
+	g := New("/data", 20, 10, time.Minute, time.Minute)
+	setAvailable(5)
+	if err := g.Check(); err != nil {
+		t.Fatal(err)
+	}
+	// A failed measure keeps the last state
+	diskUsage = func(path string) (uint64, uint64, error) {
+		return 0, 0, errors.New("statfs failed")
+	}
+	if err := g.Check(); err == nil {
+		t.Error("the error is not returned")
+	}
+	if state := g.State(); state != StateHard {
+		t.Errorf("state %s after a failed check, want hard", state)
+	}
+}
@@ -0,0 +1,180 @@
+package durability
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ooni/collector/collector/metrics"
+)
+
+// Policy tells when the writes to the report files reach the disk
+type Policy string
+
+const (
+	// None leaves the writes to the page cache, a crash of the host can lose
+	// the measurements acknowledged in the last seconds
+	None Policy = "none"
+	// Fsync syncs the file after every write
+	Fsync Policy = "fsync"
+	// Group syncs the files written by the concurrent writers every group
+	// commit interval, once per file however many writers wrote it. The
+	// writers wait for the sync.
+	Group Policy = "group"
+)
+
+// ParsePolicy parses the name of a durability policy
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case None, Fsync, Group:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid durability policy %q. Must be none, fsync or group", name)
+}
+
+// Syncer makes the writes to files durable according to a policy
+type Syncer struct {
+	Policy   Policy
+	Interval time.Duration
+
+	mu sync.Mutex
+	// batch are the files waiting for the next group commit, by path
+	batch   map[string]*groupFile
+	pending bool
+	syncs   uint64
+}
+
+// groupFile is a file waiting for a group commit along with its writers
+type groupFile struct {
+	f       *os.File
+	waiters []chan error
+}
+
+// New creates a syncer. interval is only used by the group policy.
+func New(policy Policy, interval time.Duration) *Syncer {
+	return &Syncer{
+		Policy:   policy,
+		Interval: interval,
+		batch:    make(map[string]*groupFile),
+	}
+}
+
+func (s *Syncer) sync(f *os.File) error {
+	start := time.Now()
+	err := f.Sync()
+	metrics.SyncDuration.Observe(time.Since(start).Seconds())
+	s.mu.Lock()
+	s.syncs++
+	s.mu.Unlock()
+	return err
+}
+
+// Syncs returns the number of fsync and fdatasync calls made so far
+func (s *Syncer) Syncs() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncs
+}
+
+// SyncFile returns once the writes to f are durable. f must stay open until
+// it returns.
+func (s *Syncer) SyncFile(f *os.File) error {
+	return s.SyncFiles(f)
+}
+
+// SyncFiles returns once the writes to files are durable. The files must stay
+// open until it returns.
+func (s *Syncer) SyncFiles(files ...*os.File) error {
+	switch s.Policy {
+	case Fsync:
+		for _, f := range files {
+			if err := s.sync(f); err != nil {
+				return err
+			}
+		}
+	case Group:
+		return s.groupSync(files)
+	}
+	return nil
+}
+
+// SyncDir makes the creation, removal and renaming of the files of the
+// directory durable, unless the policy is none
+func (s *Syncer) SyncDir(path string) error {
+	if s.Policy == None {
+		return nil
+	}
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return s.sync(d)
+}
+
+// groupSync adds files to the next group commit and waits for it. Syncing a
+// file flushes the writes made through any descriptor, so the writers of the
+// same file share a single sync.
+func (s *Syncer) groupSync(files []*os.File) error {
+	done := make(chan error, len(files))
+	s.mu.Lock()
+	for _, f := range files {
+		gf, ok := s.batch[f.Name()]
+		if !ok {
+			gf = &groupFile{f: f}
+			s.batch[f.Name()] = gf
+		}
+		gf.waiters = append(gf.waiters, done)
+	}
+	if !s.pending {
+		s.pending = true
+		time.AfterFunc(s.Interval, s.commit)
+	}
+	s.mu.Unlock()
+
+	var err error
+	for range files {
+		if ferr := <-done; err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// commit syncs the files of the batch, each with its own fdatasync, and
+// wakes up their writers. A sync only reports the errors of its file, so a
+// failed write is never acknowledged by the sync of another file.
+func (s *Syncer) commit() {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = make(map[string]*groupFile)
+	s.pending = false
+	s.mu.Unlock()
+
+	metrics.GroupCommitSize.Observe(float64(len(batch)))
+	var wg sync.WaitGroup
+	for _, gf := range batch {
+		wg.Add(1)
+		go func(gf *groupFile) {
+			defer wg.Done()
+			err := s.syncData(gf.f)
+			for _, done := range gf.waiters {
+				done <- err
+			}
+		}(gf)
+	}
+	wg.Wait()
+}
+
+// syncData flushes the data of f, and the metadata needed to read it back
+// such as its size, with fdatasync(2) where available
+func (s *Syncer) syncData(f *os.File) error {
+	start := time.Now()
+	err := fdatasync(f)
+	metrics.SyncDuration.Observe(time.Since(start).Seconds())
+	s.mu.Lock()
+	s.syncs++
+	s.mu.Unlock()
+	return err
+}
@@ -0,0 +1,93 @@
+package durability
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempFile(t *testing.T, dir string, name string) *os.File {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGroupSyncSharesSyncs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := tempFile(t, dir, "a"), tempFile(t, dir, "b")
+	defer a.Close()
+	defer b.Close()
+
+	s := New(Group, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.SyncFiles(a, b); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Each file is synced once per commit, whatever the number of writers
+	if syncs := s.Syncs(); syncs%2 != 0 || syncs >= 16 {
+		t.Errorf("%d syncs for 8 writers of 2 files", syncs)
+	}
+}
+
+func TestGroupSyncReportsErrorsPerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ok, broken := tempFile(t, dir, "ok"), tempFile(t, dir, "broken")
+	defer ok.Close()
+	// Syncing a closed file fails, like a failed writeback
+	broken.Close()
+
+	s := New(Group, 10*time.Millisecond)
+	errs := make(chan error, 2)
+	go func() { errs <- s.SyncFiles(ok) }()
+	go func() { errs <- s.SyncFiles(broken) }()
+	var failed int
+	for i := 0; i < 2; i++ {
+		if <-errs != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d writers got an error, want 1", failed)
+	}
+}
+
+func TestNoneDoesNotSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durability")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := tempFile(t, dir, "f")
+	defer f.Close()
+
+	s := New(None, 0)
+	if err = s.SyncFiles(f); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SyncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if syncs := s.Syncs(); syncs != 0 {
+		t.Errorf("%d syncs with the none policy", syncs)
+	}
+}
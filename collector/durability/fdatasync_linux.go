@@ -0,0 +1,13 @@
+package durability
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdatasync flushes the data of f without the metadata not needed to read it
+// back, ex. its modification time
+func fdatasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package durability
+
+import "os"
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/audit"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/logging"
+	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/storage"
+)
+
+// auditLog records an admin action together with who performed it
+func auditLog(c *gin.Context, action string, target string, err error) {
+	entry := audit.Entry{
+		User:       c.MustGet(gin.AuthUserKey).(string),
+		RemoteAddr: c.ClientIP(),
+		Action:     action,
+		Target:     target,
+		Outcome:    audit.OutcomeSuccess,
+		RequestID:  logging.RequestID(c.Request.Context()),
+	}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Error = err.Error()
+	}
+	auditLog := c.MustGet("AuditLog").(*audit.Log)
+	if err := auditLog.Record(entry); err != nil {
+		logging.With(c.Request.Context(), log).WithError(err).Error("failed to record admin action")
+	}
+}
+
+// AuditReportFileDownloads records the accesses to the report files
+func AuditReportFileDownloads(c *gin.Context) {
+	c.Next()
+
+	var err error
+	if status := c.Writer.Status(); status >= http.StatusBadRequest {
+		err = fmt.Errorf("HTTP %d", status)
+	}
+	auditLog(c, "download-report-file", c.Param("filepath"), err)
+}
+
+// AuditHandler returns the audit log entries, the most recent first. They
+// can be filtered with the action, user, target, since and until (RFC3339)
+// query parameters and limited with limit (default 100).
+func AuditHandler(c *gin.Context) {
+	auditLog := c.MustGet("AuditLog").(*audit.Log)
+
+	q := audit.Query{
+		Action: c.Query("action"),
+		User:   c.Query("user"),
+		Target: c.Query("target"),
+		Limit:  100,
+	}
+	var err error
+	if since := c.Query("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since"})
+			return
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until"})
+			return
+		}
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	entries, err := auditLog.Find(q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if entries == nil {
+		entries = []audit.Entry{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+	})
+	return
+}
+
+// adminErrorStatus maps report lifecycle errors to HTTP status codes
+func adminErrorStatus(err error) int {
+	switch err {
+	case storage.ErrReportNotFound:
+		return http.StatusNotFound
+	case report.ErrReportIsClosed, report.ErrReportIsOpen, report.ErrReportFileMissing:
+		return http.StatusConflict
+	case storage.ErrStoreNotOpen:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// AdminCloseReportHandler force-closes an open report
+func AdminCloseReportHandler(c *gin.Context) {
+	store := c.MustGet("Storage").(*storage.Storage)
+	reportID := c.Param("reportID")
+
+	err := report.CloseReport(c.Request.Context(), store, reportID)
+	auditLog(c, "close-report", reportID, err)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "closed",
+	})
+	return
+}
+
+// AdminCloseReportsHandler closes all the open reports created before the
+// cutoff given by the older-than query parameter (ex. older-than=24h)
+func AdminCloseReportsHandler(c *gin.Context) {
+	store := c.MustGet("Storage").(*storage.Storage)
+
+	olderThan, err := time.ParseDuration(c.Query("older-than"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid older-than duration",
+		})
+		return
+	}
+	closed, err := report.CloseReportsOlderThan(c.Request.Context(), store, time.Now().UTC().Add(-olderThan))
+	auditLog(c, "close-reports", "older-than="+olderThan.String(), err)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if closed == nil {
+		closed = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":     "closed",
+		"report_ids": closed,
+	})
+	return
+}
+
+// AdminReopenReportHandler reopens a report that was closed by mistake
+func AdminReopenReportHandler(c *gin.Context) {
+	store := c.MustGet("Storage").(*storage.Storage)
+	reportID := c.Param("reportID")
+
+	err := report.ReopenReport(c.Request.Context(), store, reportID)
+	auditLog(c, "reopen-report", reportID, err)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "reopened",
+	})
+	return
+}
+
+// AdminPurgeReportHandler deletes the report metadata and its files
+func AdminPurgeReportHandler(c *gin.Context) {
+	store := c.MustGet("Storage").(*storage.Storage)
+	reportID := c.Param("reportID")
+
+	err := report.PurgeReport(c.Request.Context(), store, reportID)
+	auditLog(c, "purge-report", reportID, err)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": "purged",
+	})
+	return
+}
+
+// AdminReloadConfigHandler reloads the configuration file, like SIGHUP
+func AdminReloadConfigHandler(c *gin.Context) {
+	result, err := config.Reload()
+	auditLog(c, "reload-config", config.File(), err)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// AdminBackupHandler returns the handler writing a backup of the store to
+// the backups folder of the data root while the collector keeps running
+func AdminBackupHandler(dataRoot string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		store := c.MustGet("Storage").(*storage.Storage)
+
+		path := filepath.Join(paths.BackupDir(dataRoot), fmt.Sprintf("backup-%s.jsonl",
+			time.Now().UTC().Format(report.TimestampFormat)))
+		trailer, err := store.BackupFile(c.Request.Context(), path, dataRoot)
+		auditLog(c, "backup-store", path, err)
+		if err != nil {
+			logging.With(c.Request.Context(), log).WithError(err).Error("failed to back up the store")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"path":     path,
+			"count":    trailer.Count,
+			"checksum": trailer.Checksum,
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/audit"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/spf13/viper"
+)
+
+// testCollector is a data root with its store and audit log, and a router
+// serving the handlers as an admin
+type testCollector struct {
+	dir      string
+	store    *storage.Storage
+	auditLog *audit.Log
+	router   *gin.Engine
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{paths.ReportDir(dir), paths.TempReportDir(dir), paths.BadgerDir(dir)} {
+		if err = os.Mkdir(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := viper.New()
+	config.SetDefaults(v)
+	v.Set("core.is-dev", true)
+	v.Set("core.data-root", dir)
+	cfg, err := config.Load(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = report.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	tc := &testCollector{dir: dir, store: storage.New(paths.BadgerDir(dir), cfg.Store)}
+	if err = tc.store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if tc.auditLog, err = audit.Open(paths.AuditLog(dir)); err != nil {
+		t.Fatal(err)
+	}
+
+	tc.router = gin.New()
+	tc.router.Use(func(c *gin.Context) {
+		c.Set("Storage", tc.store)
+		c.Set("AuditLog", tc.auditLog)
+		c.Set(gin.AuthUserKey, "tester")
+	})
+	tc.router.POST("/report/:reportID/close", CloseReportHandler)
+	tc.router.POST("/admin/report/:reportID/close", AdminCloseReportHandler)
+	tc.router.POST("/admin/report/:reportID/reopen", AdminReopenReportHandler)
+	tc.router.DELETE("/admin/report/:reportID", AdminPurgeReportHandler)
+	return tc
+}
+
+func (tc *testCollector) Close() {
+	report.CloseFiles()
+	tc.store.Close()
+	tc.auditLog.Close()
+	os.RemoveAll(tc.dir)
+}
+
+// do sends the request and returns the status of the response
+func (tc *testCollector) do(method string, path string) int {
+	w := httptest.NewRecorder()
+	tc.router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code
+}
+
+// newReport creates a report with an entry
+func (tc *testCollector) newReport(t *testing.T) string {
+	ctx := context.Background()
+	reportID, err := report.CreateNewReport(ctx, tc.store, "web_connectivity", "AS1", "ooniprobe", "2.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.writeEntry(t, reportID)
+	return reportID
+}
+
+func (tc *testCollector) writeEntry(t *testing.T, reportID string) {
+	entry := &report.MeasurementEntry{ReportID: reportID, ProbeASN: "AS1", ProbeCC: "IT"}
+	if _, _, err := report.WriteEntry(context.Background(), tc.store, reportID, entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (tc *testCollector) getReport(t *testing.T, reportID string) *storage.ReportMetadata {
+	meta, err := tc.store.GetReport(context.Background(), reportID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta
+}
+
+// audited returns the outcomes of the audited actions, the oldest first
+func (tc *testCollector) audited(t *testing.T) []string {
+	entries, err := tc.auditLog.Find(audit.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outcomes []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		outcomes = append(outcomes, entries[i].Action+" "+entries[i].Outcome)
+	}
+	return outcomes
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestAdminCloseAndReopen(t *testing.T) {
+	tc := newTestCollector(t)
+	defer tc.Close()
+	reportID := tc.newReport(t)
+	tmpPath := filepath.Join(paths.TempReportDir(tc.dir), reportID)
+
+	if status := tc.do("POST", "/admin/report/"+reportID+"/reopen"); status != http.StatusConflict {
+		t.Errorf("reopen an open report: %d", status)
+	}
+	if status := tc.do("POST", "/admin/report/"+reportID+"/close"); status != http.StatusOK {
+		t.Fatalf("close: %d", status)
+	}
+	meta := tc.getReport(t, reportID)
+	if !meta.Closed || filepath.Dir(meta.ReportFilePath) != paths.ReportDir(tc.dir) || !exists(meta.ReportFilePath) {
+		t.Errorf("closed report at %s, closed %v", meta.ReportFilePath, meta.Closed)
+	}
+	if exists(tmpPath) {
+		t.Error("the temporary file is left after close")
+	}
+	if status := tc.do("POST", "/admin/report/"+reportID+"/close"); status != http.StatusConflict {
+		t.Errorf("close a closed report: %d", status)
+	}
+
+	if status := tc.do("POST", "/admin/report/"+reportID+"/reopen"); status != http.StatusOK {
+		t.Fatalf("reopen: %d", status)
+	}
+	meta = tc.getReport(t, reportID)
+	if meta.Closed || meta.ReportFilePath != tmpPath || !exists(tmpPath) {
+		t.Errorf("reopened report at %s, closed %v", meta.ReportFilePath, meta.Closed)
+	}
+	// The reopened report takes new entries after the previous ones
+	tc.writeEntry(t, reportID)
+	if meta = tc.getReport(t, reportID); meta.EntryCount != 2 {
+		t.Errorf("%d entries after reopening, want 2", meta.EntryCount)
+	}
+	if status := tc.do("POST", "/report/"+reportID+"/close"); status != http.StatusOK {
+		t.Errorf("close by the probe: %d", status)
+	}
+	if status := tc.do("POST", "/report/"+reportID+"/close"); status != http.StatusNotAcceptable {
+		t.Errorf("close twice by the probe: %d", status)
+	}
+
+	want := "[reopen-report failure close-report success close-report failure reopen-report success]"
+	if got := fmt.Sprint(tc.audited(t)); got != want {
+		t.Errorf("audited %s, want %s", got, want)
+	}
+}
+
+func TestAdminReopenMissingFile(t *testing.T) {
+	tc := newTestCollector(t)
+	defer tc.Close()
+	reportID := tc.newReport(t)
+	if err := report.CloseReport(context.Background(), tc.store, reportID); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(tc.getReport(t, reportID).ReportFilePath)
+	if status := tc.do("POST", "/admin/report/"+reportID+"/reopen"); status != http.StatusConflict {
+		t.Errorf("reopen without its file: %d", status)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	tc := newTestCollector(t)
+	defer tc.Close()
+
+	for _, closed := range []bool{false, true} {
+		reportID := tc.newReport(t)
+		if closed {
+			if err := report.CloseReport(context.Background(), tc.store, reportID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		path := tc.getReport(t, reportID).ReportFilePath
+		if status := tc.do("DELETE", "/admin/report/"+reportID); status != http.StatusOK {
+			t.Fatalf("purge (closed %v): %d", closed, status)
+		}
+		if _, err := tc.store.GetReport(context.Background(), reportID); err != storage.ErrReportNotFound {
+			t.Errorf("metadata after purge (closed %v): %v", closed, err)
+		}
+		if exists(path) {
+			t.Errorf("file left after purge (closed %v)", closed)
+		}
+		if status := tc.do("DELETE", "/admin/report/"+reportID); status != http.StatusNotFound {
+			t.Errorf("purge twice: %d", status)
+		}
+	}
+	for _, action := range []string{"close", "reopen"} {
+		if status := tc.do("POST", "/admin/report/unknown/"+action); status != http.StatusNotFound {
+			t.Errorf("%s an unknown report: %d", action, status)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"regexp"
@@ -8,9 +9,13 @@ import (
 	apexLog "github.com/apex/log"
 	"github.com/gin-gonic/gin"
 	"github.com/ooni/collector/collector/info"
+	"github.com/ooni/collector/collector/logging"
+	"github.com/ooni/collector/collector/metrics"
+	"github.com/ooni/collector/collector/ratelimit"
 	"github.com/ooni/collector/collector/report"
 	"github.com/ooni/collector/collector/storage"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ooni/collector/collector/tracing"
+	"github.com/ooni/collector/collector/transport"
 )
 
 var log = apexLog.WithFields(apexLog.Fields{
@@ -32,35 +37,91 @@ var softwareNameRegexp = regexp.MustCompile("^[0-9A-Za-z_\\.+-]+$")
 var testNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_\\- ]+$")
 var probeASNRegexp = regexp.MustCompile("^AS[0-9]+$")
 
+var (
+	errInvalidSoftwareName = errors.New("Invalid software_name")
+	errInvalidTestName     = errors.New("Invalid test_name")
+	errInvalidProbeASN     = errors.New("Invalid probe_asn")
+)
+
+// validationReasons maps validation errors to the reason label of the
+// validation failures metric
+var validationReasons = map[error]string{
+	errInvalidSoftwareName:   "software_name",
+	errInvalidTestName:       "test_name",
+	errInvalidProbeASN:       "probe_asn",
+	report.ErrInvalidProbeCC: "probe_cc",
+}
+
+// countValidationFailure increments the validation failures metric when err
+// is a validation error and tells whether it was one
+func countValidationFailure(err error) bool {
+	reason, ok := validationReasons[err]
+	if ok {
+		metrics.ValidationFailures.WithLabelValues(reason).Inc()
+	}
+	return ok
+}
+
+// countBindFailure records a request body that could not be parsed
+func countBindFailure() {
+	metrics.ValidationFailures.WithLabelValues("json").Inc()
+}
+
+// bindJSON parses the request body into obj
+func bindJSON(c *gin.Context, obj interface{}) error {
+	_, span := tracing.StartSpan(c.Request.Context(), "handler.bindJSON")
+	err := c.BindJSON(obj)
+	tracing.EndSpan(span, err)
+	return err
+}
+
 func validateRequest(req *CreateReportRequest) error {
 	if softwareNameRegexp.MatchString(req.SoftwareName) != true {
-		return errors.New("Invalid software_name")
+		return errInvalidSoftwareName
 	}
 	if testNameRegexp.MatchString(req.TestName) != true {
-		return errors.New("Invalid test_name")
+		return errInvalidTestName
 	}
 	if probeASNRegexp.MatchString(req.ProbeASN) != true {
-		return errors.New("Invalid probe_asn")
+		return errInvalidProbeASN
 	}
 	return nil
 }
 
+// countMeasurement updates the per platform, per country and per transport
+// counters
+func countMeasurement(ctx context.Context, meta *storage.ReportMetadata) {
+	metrics.Measurements.WithLabelValues(transport.FromContext(ctx)).Inc()
+	metrics.Platform.WithLabelValues(meta.Platform).Inc()
+	metrics.Country.WithLabelValues(meta.ProbeCC).Inc()
+}
+
 // CreateReportHandler for report creation
 func CreateReportHandler(c *gin.Context) {
 	store := c.MustGet("Storage").(*storage.Storage)
 
 	var req CreateReportRequest
 
-	if err := c.BindJSON(&req); err != nil {
+	if err := bindJSON(c, &req); err != nil {
+		countBindFailure()
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	if err := validateRequest(&req); err != nil {
+		countValidationFailure(err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if ratelimit.AllowASN(c, ratelimit.KindCreate, req.ProbeASN) != true {
+		return
+	}
 
-	reportID, err := report.CreateNewReport(store, req.TestName, req.ProbeASN, req.SoftwareName, req.SoftwareVersion)
+	reportID, err := report.CreateNewReport(c.Request.Context(), store, req.TestName, req.ProbeASN, req.SoftwareName, req.SoftwareVersion)
+	if err == storage.ErrStoreNotOpen {
+		// The collector is being restarted, the probe can try again
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		// XXX check this against the spec
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -99,27 +160,41 @@ func UpdateReportHandler(c *gin.Context) {
 	reportID := c.Param("reportID")
 
 	var req UpdateReportRequest
-	if err = c.BindJSON(&req); err != nil {
-		log.WithError(err).Error("failed to bindJSON")
+	if err = bindJSON(c, &req); err != nil {
+		countBindFailure()
+		logging.With(c.Request.Context(), log).WithError(err).Error("failed to bindJSON")
 		return
 	}
 	entry := req.Content
+	if probeASNRegexp.MatchString(entry.ProbeASN) != true {
+		countValidationFailure(errInvalidProbeASN)
+		c.JSON(http.StatusBadRequest, gin.H{"error": errInvalidProbeASN.Error()})
+		return
+	}
+	if ratelimit.AllowASN(c, ratelimit.KindSubmit, entry.ProbeASN) != true {
+		return
+	}
 
-	measurementID, meta, err := report.WriteEntry(store, reportID, &entry)
+	measurementID, meta, err := report.WriteEntry(c.Request.Context(), store, reportID, &entry)
 	if err != nil {
 		if err == storage.ErrReportNotFound {
-			log.WithError(err).Debug("report not found error")
+			logging.With(c.Request.Context(), log).WithError(err).Debug("report not found error")
 			// XXX use the correct return value
 			c.JSON(http.StatusNotFound, gin.H{
 				"status": "not found",
 			})
+			return
 		}
-		log.WithError(err).Error("got an invalid request")
+		if err == storage.ErrStoreNotOpen {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		countValidationFailure(err)
+		logging.With(c.Request.Context(), log).WithError(err).Error("got an invalid request")
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	platformMetric.MetricCollector.(*prometheus.CounterVec).WithLabelValues(meta.Platform).Inc()
-	countryMetric.MetricCollector.(*prometheus.CounterVec).WithLabelValues(meta.ProbeCC).Inc()
+	countMeasurement(c.Request.Context(), meta)
 
 	c.JSON(http.StatusOK, gin.H{
 		"status":         "success",
@@ -133,7 +208,7 @@ func CloseReportHandler(c *gin.Context) {
 	store := c.MustGet("Storage").(*storage.Storage)
 	reportID := c.Param("reportID")
 
-	err := report.CloseReport(store, reportID)
+	err := report.CloseReport(c.Request.Context(), store, reportID)
 	if err != nil {
 		// XXX return proper error
 		c.JSON(http.StatusNotAcceptable, gin.H{
@@ -157,8 +232,9 @@ func SubmitMeasurementHandler(c *gin.Context) {
 	)
 
 	shouldClose := c.DefaultQuery("close", "false") == "true"
-	if err := c.BindJSON(&entry); err != nil {
-		log.WithError(err).Error("failed to bindJSON")
+	if err := bindJSON(c, &entry); err != nil {
+		countBindFailure()
+		logging.With(c.Request.Context(), log).WithError(err).Error("failed to bindJSON")
 		return
 	}
 	reportID = entry.ReportID
@@ -170,28 +246,41 @@ func SubmitMeasurementHandler(c *gin.Context) {
 		ProbeASN:        entry.ProbeASN,
 	}
 	if err := validateRequest(&createReq); err != nil {
+		countValidationFailure(err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
+		return
+	}
+	if ratelimit.AllowASN(c, ratelimit.KindSubmit, createReq.ProbeASN) != true {
+		return
 	}
 	if reportID == "" {
-		rid, err := report.CreateNewReport(store, createReq.TestName,
+		// Creating the report also counts against the create budgets
+		if ratelimit.Allow(c, ratelimit.KindCreate, createReq.ProbeASN) != true {
+			return
+		}
+		rid, err := report.CreateNewReport(c.Request.Context(), store, createReq.TestName,
 			createReq.ProbeASN, createReq.SoftwareName, createReq.SoftwareVersion)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"error": err.Error(),
 			})
+			return
 		}
 		reportID = rid
 	}
-	measurementID, _, err := report.WriteEntry(store, reportID, &entry)
+	measurementID, meta, err := report.WriteEntry(c.Request.Context(), store, reportID, &entry)
 	if err != nil {
+		countValidationFailure(err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
+		return
 	}
+	countMeasurement(c.Request.Context(), meta)
 	if shouldClose == true {
-		report.CloseReport(store, reportID)
+		report.CloseReport(c.Request.Context(), store, reportID)
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"report_id":      reportID,
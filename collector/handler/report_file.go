@@ -12,26 +12,30 @@ import (
 
 var filenameRegexp = regexp.MustCompile("^[0-9A-Za-z_\\.+-]+$")
 
-// DeleteReportFileHandler is a handler for delete processed report files
-func DeleteReportFileHandler(c *gin.Context) {
-	filename := c.Param("filename")
-	if filenameRegexp.MatchString(filename) != true {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "invalid filename",
-		})
-		return
-	}
+// DeleteReportFileHandler returns the handler deleting the processed report
+// files of the data root
+func DeleteReportFileHandler(dataRoot string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := c.Param("filename")
+		if filenameRegexp.MatchString(filename) != true {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "invalid filename",
+			})
+			return
+		}
 
-	fullPath := filepath.Join(paths.ReportDir(), filename)
-	err := os.Remove(fullPath)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+		fullPath := filepath.Join(paths.ReportDir(dataRoot), filename)
+		err := os.Remove(fullPath)
+		auditLog(c, "delete-report-file", filename, err)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status": "deleted",
 		})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"status": "deleted",
-	})
-	return
 }
@@ -0,0 +1,157 @@
+package health
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Status of a single check or of the whole service
+type Status string
+
+const (
+	// StatusOK means the check passed
+	StatusOK Status = "ok"
+	// StatusDegraded means a non critical check failed
+	StatusDegraded Status = "degraded"
+	// StatusFail means a critical check failed
+	StatusFail Status = "fail"
+)
+
+// CheckFunc returns a non nil error when the checked component is unhealthy
+type CheckFunc func() error
+
+// CheckResult is the outcome of a check as reported by the ready endpoint
+type CheckResult struct {
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type check struct {
+	name     string
+	critical bool
+	fn       CheckFunc
+}
+
+// ErrShuttingDown is reported while the server is shutting down
+var ErrShuttingDown = errors.New("shutting down")
+
+// Checker runs the registered readiness checks
+type Checker struct {
+	mu           sync.Mutex
+	checks       []check
+	shuttingDown int32
+}
+
+// NewChecker creates an empty checker
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Register adds a check. When a critical check fails the service is not
+// ready, when a non critical one fails the service is only degraded.
+func (hc *Checker) Register(name string, critical bool, fn CheckFunc) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.checks = append(hc.checks, check{name: name, critical: critical, fn: fn})
+}
+
+// SetShuttingDown marks the service as not ready from now on
+func (hc *Checker) SetShuttingDown() {
+	atomic.StoreInt32(&hc.shuttingDown, 1)
+}
+
+// SetServing marks the service as ready again, ex. when a restart failed
+func (hc *Checker) SetServing() {
+	atomic.StoreInt32(&hc.shuttingDown, 0)
+}
+
+// Run executes all the checks and returns the overall status with the
+// detail of every check
+func (hc *Checker) Run() (Status, map[string]CheckResult) {
+	hc.mu.Lock()
+	checks := make([]check, len(hc.checks))
+	copy(checks, hc.checks)
+	hc.mu.Unlock()
+
+	status := StatusOK
+	results := make(map[string]CheckResult)
+	if atomic.LoadInt32(&hc.shuttingDown) == 1 {
+		status = StatusFail
+		results["shutdown"] = CheckResult{Status: StatusFail, Error: ErrShuttingDown.Error()}
+	}
+	for _, chk := range checks {
+		err := chk.fn()
+		if err == nil {
+			results[chk.name] = CheckResult{Status: StatusOK}
+			continue
+		}
+		result := CheckResult{Status: StatusDegraded, Error: err.Error()}
+		if chk.critical == true {
+			result.Status = StatusFail
+			status = StatusFail
+		} else if status == StatusOK {
+			status = StatusDegraded
+		}
+		results[chk.name] = result
+	}
+	return status, results
+}
+
+// LiveHandler answers as long as the process is able to serve requests
+func (hc *Checker) LiveHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": StatusOK,
+	})
+}
+
+// ReadyHandler reports whether the service is ready to receive traffic
+func (hc *Checker) ReadyHandler(c *gin.Context) {
+	status, results := hc.Run()
+	code := http.StatusOK
+	if status == StatusFail {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": results,
+	})
+}
+
+// Cached wraps fn so that it's executed at most once every ttl. This is
+// useful for checks that go over the network.
+func Cached(fn CheckFunc, ttl time.Duration) CheckFunc {
+	var (
+		mu      sync.Mutex
+		lastRun time.Time
+		lastErr error
+	)
+	return func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(lastRun) < ttl {
+			return lastErr
+		}
+		lastErr = fn()
+		lastRun = time.Now()
+		return lastErr
+	}
+}
+
+// DirWritable returns a check that verifies files can be created in dir
+func DirWritable(dir string) CheckFunc {
+	return func() error {
+		f, err := ioutil.TempFile(dir, ".ready-")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,123 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errBroken = errors.New("broken")
+
+func failing() error { return errBroken }
+
+func passing() error { return nil }
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		critical CheckFunc
+		optional CheckFunc
+		want     Status
+		wantS3   Status
+	}{
+		{"all pass", passing, passing, StatusOK, StatusOK},
+		{"non critical fails", passing, failing, StatusDegraded, StatusDegraded},
+		{"critical fails", failing, passing, StatusFail, StatusOK},
+		{"both fail", failing, failing, StatusFail, StatusDegraded},
+	}
+	for _, tt := range tests {
+		hc := NewChecker()
+		hc.Register("store", true, tt.critical)
+		hc.Register("s3", false, tt.optional)
+		status, results := hc.Run()
+		if status != tt.want {
+			t.Errorf("%s: status %s, want %s", tt.name, status, tt.want)
+		}
+		if results["s3"].Status != tt.wantS3 {
+			t.Errorf("%s: s3 %+v, want %s", tt.name, results["s3"], tt.wantS3)
+		}
+		if tt.critical() != nil && results["store"] != (CheckResult{Status: StatusFail, Error: "broken"}) {
+			t.Errorf("%s: store %+v", tt.name, results["store"])
+		}
+	}
+}
+
+// ready returns the status code and the status of the ready endpoint
+func ready(t *testing.T, hc *Checker) (int, Status) {
+	router := gin.New()
+	router.GET("/ready", hc.ReadyHandler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	var body struct {
+		Status Status                 `json:"status"`
+		Checks map[string]CheckResult `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, body.Status
+}
+
+func TestReadyHandler(t *testing.T) {
+	hc := NewChecker()
+	hc.Register("store", true, passing)
+	hc.Register("s3", false, failing)
+	// A degraded service keeps receiving traffic
+	if code, status := ready(t, hc); code != http.StatusOK || status != StatusDegraded {
+		t.Errorf("degraded: %d %s", code, status)
+	}
+
+	hc.SetShuttingDown()
+	if code, status := ready(t, hc); code != http.StatusServiceUnavailable || status != StatusFail {
+		t.Errorf("shutting down: %d %s", code, status)
+	}
+	if _, results := hc.Run(); results["shutdown"].Error != ErrShuttingDown.Error() {
+		t.Errorf("shutdown %+v", results["shutdown"])
+	}
+
+	hc.SetServing()
+	if code, status := ready(t, hc); code != http.StatusOK || status != StatusDegraded {
+		t.Errorf("serving again: %d %s", code, status)
+	}
+}
+
+func TestCached(t *testing.T) {
+	runs := 0
+	fn := Cached(func() error {
+		runs++
+		return errBroken
+	}, time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := fn(); err != errBroken {
+			t.Errorf("run %d: %v", i, err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("ran %d times, want 1", runs)
+	}
+}
+
+func TestDirWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = DirWritable(dir)(); err != nil {
+		t.Error(err)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 0 {
+		t.Errorf("%d files left", len(infos))
+	}
+	if err = DirWritable(filepath.Join(dir, "missing"))(); err == nil {
+		t.Error("a missing dir is writable")
+	}
+}
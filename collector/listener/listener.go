@@ -0,0 +1,134 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/facebookgo/grace/gracenet"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "listener",
+	"cmd": "ooni-collector",
+})
+
+const unixPrefix = "unix:"
+
+// Parse splits a listen address into the network and the address to pass
+// to net.Listen. It accepts "unix:/path/to/socket", "tcp:host:port" and
+// "host:port".
+func Parse(spec string) (string, string, error) {
+	if strings.HasPrefix(spec, unixPrefix) {
+		path := strings.TrimPrefix(spec, unixPrefix)
+		if path == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: missing socket path", spec)
+		}
+		return "unix", path, nil
+	}
+	addr := strings.TrimPrefix(spec, "tcp:")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %v", spec, err)
+	}
+	return "tcp", addr, nil
+}
+
+// inherited tells whether the process was given its sockets by its parent,
+// either a previous collector being restarted or systemd
+func inherited() bool {
+	return os.Getenv("LISTEN_FDS") != ""
+}
+
+// fromSystemd tells whether the sockets were passed by systemd socket
+// activation, which sets LISTEN_PID to the pid of the process. A collector
+// restarted from it inherits the variable with the pid of its parent.
+func fromSystemd() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid())
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous
+// collector that wasn't shut down cleanly, so that it can be bound again
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
+
+// Listen opens the listener for spec through n. Sockets inherited from the
+// parent process (through LISTEN_FDS, as gracehttp restarts and systemd
+// socket activation do) are reused when their address matches spec.
+// Newly created unix sockets get the permissions in socketMode.
+// Closing a unix listener leaves its socket in place, as the process it was
+// handed over to may still be serving on it, see removeSockets.
+func Listen(n *gracenet.Net, spec string, socketMode os.FileMode) (net.Listener, error) {
+	network, addr, err := Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network != "unix" {
+		return n.Listen(network, addr)
+	}
+	if !inherited() {
+		if err = removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+	}
+	l, err := n.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	if inherited() {
+		return l, nil
+	}
+	if err = os.Chmod(addr, socketMode); err != nil {
+		l.Close()
+		os.Remove(addr)
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeSockets removes the unix sockets listened on by specs, once the
+// collector stopped for good. The sockets passed by systemd belong to it and
+// are left alone.
+func removeSockets(specs []string) {
+	if fromSystemd() {
+		return
+	}
+	for _, spec := range specs {
+		network, addr, err := Parse(spec)
+		if err != nil || network != "unix" {
+			continue
+		}
+		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Errorf("failed to remove %s", addr)
+		}
+	}
+}
+
+// ParseMode parses an octal file mode such as "0660"
+func ParseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,150 @@
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/facebookgo/grace/gracenet"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec    string
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{spec: "127.0.0.1:8080", network: "tcp", addr: "127.0.0.1:8080"},
+		{spec: "tcp:127.0.0.1:8080", network: "tcp", addr: "127.0.0.1:8080"},
+		{spec: "[::1]:8080", network: "tcp", addr: "[::1]:8080"},
+		{spec: ":8080", network: "tcp", addr: ":8080"},
+		{spec: "unix:/run/ooni-collector/http.sock", network: "unix", addr: "/run/ooni-collector/http.sock"},
+		{spec: "unix:", wantErr: true},
+		{spec: "127.0.0.1", wantErr: true},
+		{spec: "tcp:", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		network, addr, err := Parse(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %q, %q, want an error", tt.spec, network, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if network != tt.network || addr != tt.addr {
+			t.Errorf("Parse(%q) = %q, %q, want %q, %q", tt.spec, network, addr, tt.network, tt.addr)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// staleSocket leaves a socket without a listener at path, like a collector
+// that was killed
+func staleSocket(t *testing.T, path string) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("missing socket: %v", err)
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	staleSocket(t, stale)
+	if err := removeStaleSocket(stale); err != nil {
+		t.Errorf("stale socket: %v", err)
+	}
+	if _, err := os.Lstat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale socket not removed: %v", err)
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := removeStaleSocket(live); err == nil {
+		t.Error("socket in use removed")
+	}
+
+	regular := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(regular, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket(regular); err == nil {
+		t.Error("regular file removed")
+	}
+	if _, err := os.Lstat(regular); err != nil {
+		t.Errorf("regular file: %v", err)
+	}
+}
+
+func TestListenKeepsSocketOnClose(t *testing.T) {
+	os.Unsetenv("LISTEN_FDS")
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "http.sock")
+	staleSocket(t, path)
+
+	var n gracenet.Net
+	l, err := Listen(&n, "unix:"+path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0660 {
+		t.Errorf("socket mode = %o, want 660", mode)
+	}
+	// The process the socket was handed over to is still serving on it
+	l.Close()
+	if _, err = os.Lstat(path); err != nil {
+		t.Errorf("socket removed on close: %v", err)
+	}
+
+	removeSockets([]string{"127.0.0.1:8080", "unix:" + path})
+	if _, err = os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on shutdown: %v", err)
+	}
+}
+
+func TestRemoveSocketsLeavesSystemdSockets(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "http.sock")
+	staleSocket(t, path)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	defer os.Unsetenv("LISTEN_PID")
+	removeSockets([]string{"unix:" + path})
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("systemd socket removed: %v", err)
+	}
+}
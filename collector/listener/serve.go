@@ -0,0 +1,147 @@
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/facebookgo/grace/gracenet"
+	"github.com/ooni/collector/collector/proxyproto"
+)
+
+// shutdownTimeout is how long the in flight requests are given to complete
+// when stopping
+const shutdownTimeout = time.Minute
+
+// Server is an http.Server along with the address it listens on
+type Server struct {
+	*http.Server
+	Listen string
+	// ProxyProtocol is set when the connections start with a PROXY header
+	ProxyProtocol bool
+}
+
+// Options tune the behaviour of Serve
+type Options struct {
+	// PreStartProcess is called before starting the new process on restart
+	PreStartProcess func() error
+	// StartProcessFailed is called when the new process could not be
+	// started, to undo PreStartProcess and keep serving
+	StartProcessFailed func() error
+	// SocketMode is the permission of the unix sockets that are created
+	SocketMode os.FileMode
+	// Trusted tells whether a proxy may send a PROXY header
+	Trusted func(net.IP) bool
+}
+
+// Serve serves on all the servers until the process is asked to stop. It
+// follows the gracehttp restart flow: SIGUSR2 starts a new process handing
+// over the listening sockets, which terminates its parent once it's serving,
+// and SIGINT or SIGTERM drain the in flight requests before returning.
+func Serve(servers []Server, opts Options) error {
+	var (
+		n         gracenet.Net
+		listeners []net.Listener
+		specs     []string
+		// handedOver is set once a new process inherited the sockets
+		handedOver bool
+	)
+	for _, s := range servers {
+		specs = append(specs, s.Listen)
+		l, err := Listen(&n, s.Listen, opts.SocketMode)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if s.ProxyProtocol {
+			l = &proxyproto.Listener{Listener: l, Trusted: opts.Trusted}
+		}
+		if s.TLSConfig != nil {
+			l = tls.NewListener(l, s.TLSConfig)
+		}
+		log.Infof("serving on %s", s.Listen)
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func(s Server, l net.Listener) {
+			defer wg.Done()
+			if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(s, listeners[i])
+	}
+
+	// Once serving, terminate the collector we were restarted from. When
+	// the sockets come from systemd our parent is init and is left alone.
+	if ppid := os.Getppid(); inherited() && ppid != 1 {
+		if err := syscall.Kill(ppid, syscall.SIGTERM); err != nil {
+			log.WithError(err).Errorf("failed to close parent %d", ppid)
+		}
+	}
+
+	signals := make(chan os.Signal, 10)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case err := <-errs:
+			shutdown(servers)
+			if !handedOver {
+				removeSockets(specs)
+			}
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGUSR2 {
+				shutdown(servers)
+				wg.Wait()
+				if !handedOver {
+					removeSockets(specs)
+				}
+				return nil
+			}
+			if err := startProcess(&n, opts); err != nil {
+				log.WithError(err).Error("failed to start the new process")
+				if opts.StartProcessFailed != nil {
+					if err = opts.StartProcessFailed(); err != nil {
+						log.WithError(err).Error("failed to resume serving")
+					}
+				}
+				continue
+			}
+			handedOver = true
+		}
+	}
+}
+
+// startProcess starts the new process the sockets are handed over to
+func startProcess(n *gracenet.Net, opts Options) error {
+	if opts.PreStartProcess != nil {
+		if err := opts.PreStartProcess(); err != nil {
+			return err
+		}
+	}
+	_, err := n.StartProcess()
+	return err
+}
+
+func shutdown(servers []Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(ctx); err != nil {
+			log.WithError(err).Errorf("failed to shut down %s", s.Listen)
+		}
+	}
+}
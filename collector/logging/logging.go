@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/cli"
+	"github.com/apex/log/handlers/json"
+	"github.com/apex/log/handlers/logfmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/transport"
+	"github.com/rs/xid"
+)
+
+// RequestIDHeader is the header carrying the request ID
+const RequestIDHeader = "X-Request-ID"
+
+// Setup configures the global logger. format is one of text, json or logfmt.
+func Setup(format string, level string) error {
+	switch format {
+	case "", "text":
+		apexLog.SetHandler(cli.Default)
+	case "json":
+		apexLog.SetHandler(json.New(os.Stderr))
+	case "logfmt":
+		apexLog.SetHandler(logfmt.New(os.Stderr))
+	default:
+		return fmt.Errorf("invalid log format %q. Must be one of text, json, logfmt", format)
+	}
+	lvl, err := apexLog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q. Must be one of debug, info, warn, error, fatal", level)
+	}
+	apexLog.SetLevel(lvl)
+	return nil
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request ctx belongs to, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// With returns logger annotated with the request ID found in ctx
+func With(ctx context.Context, logger *apexLog.Entry) *apexLog.Entry {
+	if id := RequestID(ctx); id != "" {
+		return logger.WithField("request_id", id)
+	}
+	return logger
+}
+
+var requestIDRegexp = regexp.MustCompile("^[0-9A-Za-z_\\.-]{1,64}$")
+
+// RequestIDMiddleware assigns an ID to every request, reusing the one sent
+// by the client or a proxy when it looks sane, and echoes it back
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(RequestIDHeader)
+		if requestIDRegexp.MatchString(id) != true {
+			id = xid.New().String()
+		}
+		c.Header(RequestIDHeader, id)
+		ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// RecoveryMiddleware answers 500 to the requests whose handler panicked and
+// logs the panic and its stack through logger, with the request ID
+func RecoveryMiddleware(logger *apexLog.Entry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// The client went away, net/http handles it
+				panic(err)
+			}
+			With(c.Request.Context(), logger).WithFields(apexLog.Fields{
+				"method": c.Request.Method,
+				"path":   c.Request.URL.Path,
+				"stack":  string(debug.Stack()),
+			}).Errorf("panic serving the request: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+		c.Next()
+	}
+}
+
+const redactedValue = "redacted"
+
+// AccessLogMiddleware logs every request through logger, replacing the
+// value of the redacted fields (ex. client_ip). The client_ip of requests
+// coming over tor is never logged.
+func AccessLogMiddleware(logger *apexLog.Entry, redacted []string) gin.HandlerFunc {
+	redactedFields := make(map[string]bool)
+	for _, field := range redacted {
+		redactedFields[field] = true
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		c.Next()
+
+		fields := apexLog.Fields{
+			"method":     c.Request.Method,
+			"path":       path,
+			"status":     c.Writer.Status(),
+			"size":       c.Writer.Size(),
+			"duration":   time.Since(start).String(),
+			"client_ip":  c.ClientIP(),
+			"user_agent": c.Request.UserAgent(),
+			"transport":  transport.FromContext(c.Request.Context()),
+		}
+		if transport.IsOnion(c.Request.Context()) {
+			delete(fields, "client_ip")
+		}
+		for field := range fields {
+			if redactedFields[field] == true {
+				fields[field] = redactedValue
+			}
+		}
+		entry := With(c.Request.Context(), logger).WithFields(fields)
+		if len(c.Errors) > 0 {
+			entry.Error(c.Errors.String())
+			return
+		}
+		entry.Info("request")
+	}
+}
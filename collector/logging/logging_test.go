@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	apexLog "github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := memory.New()
+	logger := apexLog.NewEntry(&apexLog.Logger{Handler: handler, Level: apexLog.InfoLevel})
+
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.Use(RecoveryMiddleware(logger))
+	router.POST("/report", func(c *gin.Context) { panic("boom") })
+
+	req := httptest.NewRequest("POST", "/report", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if len(handler.Entries) != 1 {
+		t.Fatalf("logged %d entries, want 1", len(handler.Entries))
+	}
+	entry := handler.Entries[0]
+	if entry.Level != apexLog.ErrorLevel || !strings.Contains(entry.Message, "boom") {
+		t.Errorf("logged %s %q", entry.Level, entry.Message)
+	}
+	if entry.Fields["request_id"] != "abc" {
+		t.Errorf("request_id = %v, want abc", entry.Fields["request_id"])
+	}
+	if stack, _ := entry.Fields["stack"].(string); !strings.Contains(stack, "logging.TestRecoveryMiddleware") {
+		t.Errorf("stack = %q", stack)
+	}
+}
@@ -0,0 +1,199 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Subsystem is the prefix of all the ooni-collector metrics
+const Subsystem = "oonicollector"
+
+var (
+	// Platform counts the measurements per platform
+	Platform = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "platform_count",
+		Help:      "Counter of measurements per platform",
+	}, []string{"platform"})
+
+	// Country counts the measurements per country
+	Country = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "country_count",
+		Help:      "Counter of measurements per country",
+	}, []string{"probe_cc"})
+
+	// OpenReports is the number of reports currently open
+	OpenReports = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: Subsystem,
+		Name:      "open_reports",
+		Help:      "Number of reports currently open",
+	})
+
+	// ReportsCreated counts the created reports
+	ReportsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "reports_created_total",
+		Help:      "Counter of created reports",
+	}, []string{"test_name", "transport"})
+
+	// Measurements counts the measurements received per transport
+	Measurements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "measurements_total",
+		Help:      "Counter of measurements received per transport",
+	}, []string{"transport"})
+
+	// ReportsClosed counts the closed reports, including the expired ones
+	ReportsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "reports_closed_total",
+		Help:      "Counter of closed reports",
+	}, []string{"test_name"})
+
+	// ReportsExpired counts the reports closed because of inactivity
+	ReportsExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "reports_expired_total",
+		Help:      "Counter of reports closed because they expired",
+	}, []string{"test_name"})
+
+	// EntrySize is the size of the measurement entries written to reports
+	EntrySize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: Subsystem,
+		Name:      "entry_size_bytes",
+		Help:      "Size of the measurement entries written to reports",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+	})
+
+	// EntryWriteDuration is the time spent appending an entry to a report
+	EntryWriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: Subsystem,
+		Name:      "entry_write_duration_seconds",
+		Help:      "Time spent writing a measurement entry to a report",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	// SyncDuration is the time spent syncing the report files and folders
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: Subsystem,
+		Name:      "sync_duration_seconds",
+		Help:      "Time spent syncing report files and folders to disk",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	// GroupCommitSize is the number of files synced by a group commit
+	GroupCommitSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: Subsystem,
+		Name:      "group_commit_files",
+		Help:      "Number of report files synced together by a group commit",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	// TornEntries counts the torn entries truncated from the report files
+	TornEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "torn_entries_total",
+		Help:      "Counter of torn measurement entries truncated from report files",
+	}, []string{"stage"})
+
+	// ValidationFailures counts the submissions refused as invalid
+	ValidationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "validation_failures_total",
+		Help:      "Counter of submissions refused because they are invalid",
+	}, []string{"reason"})
+
+	// SinkUploads counts the uploads to each sink by result
+	SinkUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "sink_uploads_total",
+		Help:      "Counter of closed reports shipped to a sink",
+	}, []string{"sink", "result"})
+
+	// SinkUploadDuration is the time spent shipping a report to each sink
+	SinkUploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: Subsystem,
+		Name:      "sink_upload_duration_seconds",
+		Help:      "Time spent shipping a closed report to a sink",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"sink"})
+
+	// BadgerGC counts the badger value log garbage collections by result
+	BadgerGC = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "badger_gc_total",
+		Help:      "Counter of badger value log garbage collections",
+	}, []string{"result"})
+
+	// MetadataExpiring counts the reports whose metadata was about to expire
+	MetadataExpiring = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "metadata_expiring_total",
+		Help:      "Counter of reports whose metadata was about to expire, by state",
+	}, []string{"state"})
+
+	// RetentionFilesDeleted counts the files deleted by the retention policy
+	RetentionFilesDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "retention_files_deleted_total",
+		Help:      "Counter of report files deleted by the retention policy",
+	}, []string{"reason"})
+
+	// RetentionBytesReclaimed counts the bytes freed by the retention policy
+	RetentionBytesReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "retention_bytes_reclaimed_total",
+		Help:      "Counter of bytes reclaimed by the retention policy",
+	}, []string{"reason"})
+
+	// DiskAvailable is the free space on the data root
+	DiskAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: Subsystem,
+		Name:      "disk_available_bytes",
+		Help:      "Available bytes on the filesystem holding the data root",
+	})
+
+	// DiskGuardState is the state of the disk guard
+	DiskGuardState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Subsystem: Subsystem,
+		Name:      "disk_guard_state",
+		Help:      "State of the disk guard (0 ok, 1 soft, 2 hard)",
+	})
+
+	// RateLimited counts the requests refused by the rate limits
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Subsystem: Subsystem,
+		Name:      "rate_limited_total",
+		Help:      "Counter of requests refused because a rate limit was exceeded",
+	}, []string{"kind", "scope"})
+)
+
+// all lists every ooni-collector specific metric
+var all = []prometheus.Collector{
+	Platform,
+	Country,
+	OpenReports,
+	ReportsCreated,
+	Measurements,
+	ReportsClosed,
+	ReportsExpired,
+	EntrySize,
+	EntryWriteDuration,
+	SyncDuration,
+	GroupCommitSize,
+	TornEntries,
+	ValidationFailures,
+	SinkUploads,
+	SinkUploadDuration,
+	BadgerGC,
+	MetadataExpiring,
+	RetentionFilesDeleted,
+	RetentionBytesReclaimed,
+	DiskAvailable,
+	DiskGuardState,
+	RateLimited,
+}
+
+// Register registers all the ooni-collector specific metrics with the
+// default prometheus registry
+func Register() {
+	prometheus.MustRegister(all...)
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/audit"
+)
+
+// GinAuditMiddleware an audit log aware middleware.
+// It will set the AuditLog property, that can be accessed via:
+// auditLog := c.MustGet("AuditLog").(*audit.Log)
+type GinAuditMiddleware struct {
+	AuditLog *audit.Log
+}
+
+// MiddlewareFunc this is what you register as the middleware, like this:
+// router.Use(auditMiddleware.MiddlewareFunc())
+func (mw *GinAuditMiddleware) MiddlewareFunc() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("AuditLog", mw.AuditLog)
+		c.Next()
+	}
+}
+
+// InitAuditMiddleware create the middleware that injects the audit log
+func InitAuditMiddleware(path string) (*GinAuditMiddleware, error) {
+	auditLog, err := audit.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GinAuditMiddleware{AuditLog: auditLog}, nil
+}
@@ -2,21 +2,29 @@ package paths
 
 import (
 	"path/filepath"
-
-	"github.com/spf13/viper"
 )
 
 // ReportDir is the path to use for storing completed reports
-func ReportDir() string {
-	return filepath.Join(viper.GetString("core.data-root"), "reports")
+func ReportDir(dataRoot string) string {
+	return filepath.Join(dataRoot, "reports")
 }
 
 // TempReportDir is the path to use for storing temporary reports
-func TempReportDir() string {
-	return filepath.Join(viper.GetString("core.data-root"), "temp-reports")
+func TempReportDir(dataRoot string) string {
+	return filepath.Join(dataRoot, "temp-reports")
+}
+
+// AuditLog is the path to the audit log of admin actions
+func AuditLog(dataRoot string) string {
+	return filepath.Join(dataRoot, "audit.log")
 }
 
 // BadgerDir is the path to the badger database
-func BadgerDir() string {
-	return filepath.Join(viper.GetString("core.data-root"), "badger")
+func BadgerDir(dataRoot string) string {
+	return filepath.Join(dataRoot, "badger")
+}
+
+// BackupDir is the path where the online backups of the store are written
+func BackupDir(dataRoot string) string {
+	return filepath.Join(dataRoot, "backups")
 }
@@ -0,0 +1,206 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "proxyproto",
+	"cmd": "ooni-collector",
+})
+
+const (
+	// headerTimeout is how long a proxy has to send the PROXY header
+	headerTimeout = 5 * time.Second
+	// maxV1Header is the longest version 1 header, CRLF included
+	maxV1Header = 107
+	// maxV2Payload is the longest version 2 address block accepted, with
+	// room for the TLVs of HAProxy and the AWS load balancers
+	maxV2Payload = 4096
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrUntrustedSource is returned for connections that don't come from a
+	// trusted proxy
+	ErrUntrustedSource = errors.New("connection from an untrusted proxy")
+	// ErrMissingHeader is returned for connections without a PROXY header
+	ErrMissingHeader = errors.New("missing PROXY protocol header")
+)
+
+// Listener accepts connections from proxies speaking the PROXY protocol
+// (version 1 or 2) and reports the address of the client they forward as
+// the remote address of the connection
+type Listener struct {
+	net.Listener
+	// Trusted tells whether the proxy at the given address is allowed to
+	// send a PROXY header
+	Trusted func(net.IP) bool
+}
+
+// Accept waits for the next connection. The PROXY header is read from the
+// connection goroutine, on the first Read or RemoteAddr.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, trusted: l.Trusted, r: bufio.NewReader(c)}, nil
+}
+
+// Conn is a connection carrying a PROXY header
+type Conn struct {
+	net.Conn
+	trusted func(net.IP) bool
+	r       *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		if tcpAddr, ok := c.remoteAddr.(*net.TCPAddr); ok && !c.trusted(tcpAddr.IP) {
+			c.err = ErrUntrustedSource
+		} else {
+			c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+			c.err = c.parseHeader()
+			if c.err == io.EOF {
+				// A truncated header is not the end of an empty request
+				c.err = io.ErrUnexpectedEOF
+			}
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+		if c.err != nil {
+			log.WithError(c.err).WithField("proxy", c.Conn.RemoteAddr().String()).Warn("refusing connection")
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *Conn) parseHeader() error {
+	peek, err := c.r.Peek(len(v2Signature))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if bytes.HasPrefix(peek, v1Prefix) {
+		return c.parseV1()
+	}
+	if bytes.Equal(peek, v2Signature) {
+		return c.parseV2()
+	}
+	return ErrMissingHeader
+}
+
+// parseV1 parses the human readable header, ex.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func (c *Conn) parseV1() error {
+	var line []byte
+	for len(line) < maxV1Header {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid PROXY v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("invalid PROXY v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 ||
+		strings.Contains(fields[2], ":") != (fields[1] == "TCP6") {
+		return errors.New("invalid PROXY v1 source address")
+	}
+	c.remoteAddr = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
+
+// parseV2 parses the binary header
+func (c *Conn) parseV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	size := binary.BigEndian.Uint16(header[14:16])
+	if size > maxV2Payload {
+		return fmt.Errorf("PROXY v2 header too long (%d bytes)", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	// LOCAL connections are health checks made by the proxy itself
+	if command == 0 {
+		return nil
+	}
+	if command != 1 {
+		return fmt.Errorf("invalid PROXY v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return errors.New("short PROXY v2 address")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return errors.New("short PROXY v2 address")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}
+	}
+	// Other families (UDP, unix) keep the address of the proxy
+	return nil
+}
+
+// Read reads from the connection after the PROXY header
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client forwarded by the proxy
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
@@ -0,0 +1,220 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConn is a connection reading data, from the peer at remote
+type fakeConn struct {
+	net.Conn
+	r      *bytes.Reader
+	remote net.Addr
+	closed bool
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)        { return c.r.Read(b) }
+func (c *fakeConn) RemoteAddr() net.Addr              { return c.remote }
+func (c *fakeConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+var proxyAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+func trustTen(ip net.IP) bool {
+	_, ten, _ := net.ParseCIDR("10.0.0.0/8")
+	return ten.Contains(ip)
+}
+
+// newConn returns the connection the listener would accept from remote,
+// sending data
+func newConn(data []byte, remote net.Addr) (*Conn, *fakeConn) {
+	fc := &fakeConn{r: bytes.NewReader(data), remote: remote}
+	return &Conn{Conn: fc, trusted: trustTen, r: bufio.NewReader(fc)}, fc
+}
+
+// v2Header returns a version 2 header with the command, the address family
+// and the address block
+func v2Header(command byte, family byte, payload []byte) []byte {
+	h := append([]byte{}, v2Signature...)
+	h = append(h, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(h[14:16], uint16(len(payload)))
+	return append(h, payload...)
+}
+
+func v2IPv4(src string, port uint16) []byte {
+	b := make([]byte, 12)
+	copy(b[0:4], net.ParseIP(src).To4())
+	copy(b[4:8], net.ParseIP("198.51.100.1").To4())
+	binary.BigEndian.PutUint16(b[8:10], port)
+	binary.BigEndian.PutUint16(b[10:12], 443)
+	return b
+}
+
+func v2IPv6(src string, port uint16) []byte {
+	b := make([]byte, 36)
+	copy(b[0:16], net.ParseIP(src))
+	copy(b[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(b[32:34], port)
+	binary.BigEndian.PutUint16(b[34:36], 443)
+	return b
+}
+
+func TestConn(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\n"
+	tests := []struct {
+		name   string
+		header []byte
+		remote net.Addr
+		// want is the remote address, empty when the connection is refused
+		want string
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			want:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+			want:   proxyAddr.String(),
+		},
+		{name: "v1 without CRLF", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n")},
+		{name: "v1 truncated", header: []byte("PROXY TCP4 192.0.2.1 198.5")},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n")},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 192.0.2.999 198.51.100.1 56324 443\r\n")},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n")},
+		{name: "v1 family mismatch", header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{name: "v1 unknown protocol", header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n")},
+		{
+			name:   "v1 oversized",
+			header: []byte("PROXY TCP6 " + strings.Repeat("0", 100) + " 2001:db8::2 56324 443\r\n"),
+		},
+		{
+			name:   "v2 tcp4",
+			header: v2Header(1, 0x11, v2IPv4("192.0.2.1", 56324)),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			name:   "v2 tcp6",
+			header: v2Header(1, 0x21, v2IPv6("2001:db8::1", 56324)),
+			want:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2 with TLVs",
+			header: v2Header(1, 0x11, append(v2IPv4("192.0.2.1", 56324), 0x04, 0, 1, 'x')),
+			want:   "192.0.2.1:56324",
+		},
+		{
+			// Health checks of the proxy itself
+			name:   "v2 local",
+			header: v2Header(0, 0x00, nil),
+			want:   proxyAddr.String(),
+		},
+		{
+			name:   "v2 udp",
+			header: v2Header(1, 0x12, v2IPv4("192.0.2.1", 56324)),
+			want:   proxyAddr.String(),
+		},
+		{
+			name:   "v2 unix",
+			header: v2Header(1, 0x31, make([]byte, 216)),
+			want:   proxyAddr.String(),
+		},
+		{name: "v2 short address", header: v2Header(1, 0x11, v2IPv4("192.0.2.1", 56324)[:8])},
+		{name: "v2 short ipv6 address", header: v2Header(1, 0x21, v2IPv4("192.0.2.1", 56324))},
+		{name: "v2 invalid command", header: v2Header(2, 0x11, v2IPv4("192.0.2.1", 56324))},
+		{name: "v2 truncated header", header: v2Header(1, 0x11, nil)[:14]},
+		{name: "v2 truncated address", header: v2Header(1, 0x11, v2IPv4("192.0.2.1", 56324))[:20]},
+		{name: "v2 oversized", header: v2Header(1, 0x11, make([]byte, maxV2Payload+1))},
+		{
+			name:   "v2 invalid version",
+			header: append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0),
+		},
+		{name: "missing header", header: []byte("GET / HTTP/1.1\r\n")},
+		{name: "empty connection", header: nil},
+		{
+			name:   "untrusted proxy",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000},
+		},
+		{
+			name:   "untrusted v2 proxy",
+			header: v2Header(1, 0x11, v2IPv4("192.0.2.1", 56324)),
+			remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000},
+		},
+	}
+	for _, tt := range tests {
+		remote := tt.remote
+		if remote == nil {
+			remote = proxyAddr
+		}
+		data := tt.header
+		if tt.want != "" {
+			data = append(data, request...)
+		}
+		c, fc := newConn(data, remote)
+		addr := c.RemoteAddr().String()
+		data, err := ioutil.ReadAll(c)
+		if tt.want == "" {
+			if err == nil || !fc.closed {
+				t.Errorf("%s: connection accepted from %s", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if addr != tt.want {
+			t.Errorf("%s: remote address = %s, want %s", tt.name, addr, tt.want)
+		}
+		if string(data) != request {
+			t.Errorf("%s: read %q after the header, want %q", tt.name, data, request)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{Listener: inner, Trusted: func(ip net.IP) bool { return ip.IsLoopback() }}
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nping"))
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := c.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("remote address = %s", addr)
+	}
+	data, err := ioutil.ReadAll(c)
+	if err != nil || string(data) != "ping" {
+		t.Errorf("read %q, %v", data, err)
+	}
+}
@@ -0,0 +1,270 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/logging"
+	"github.com/ooni/collector/collector/metrics"
+	"github.com/ooni/collector/collector/transport"
+	"golang.org/x/time/rate"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "ratelimit",
+	"cmd": "ooni-collector",
+})
+
+const (
+	// KindCreate is the budget for report creation
+	KindCreate = "create"
+	// KindSubmit is the budget for measurement submission
+	KindSubmit = "submit"
+
+	// ScopeIP limits each client address
+	ScopeIP = "ip"
+	// ScopeASN limits each claimed probe_asn
+	ScopeASN = "asn"
+	// ScopeGlobal limits all the clients together
+	ScopeGlobal = "global"
+)
+
+var (
+	kinds  = []string{KindCreate, KindSubmit}
+	scopes = []string{ScopeIP, ScopeASN, ScopeGlobal}
+)
+
+// idleTimeout is after how long the bucket of an idle key is forgotten
+const idleTimeout = 10 * time.Minute
+
+// Budget is a token bucket refilled with Rate tokens per minute holding at
+// most Burst tokens. A zero Rate means unlimited.
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedLimiter holds a token bucket per key
+type keyedLimiter struct {
+	budget  Budget
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newKeyedLimiter(budget Budget) *keyedLimiter {
+	return &keyedLimiter{
+		budget:  budget,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// reserve takes a token from the bucket of key. It returns the
+// reservation, nil when the budget is unlimited, to give the token back.
+// When there are none left it returns how long to wait for the next one.
+func (kl *keyedLimiter) reserve(key string, now time.Time) (*rate.Reservation, time.Duration) {
+	if kl.budget.Rate <= 0 {
+		return nil, 0
+	}
+
+	kl.mu.Lock()
+	b, ok := kl.buckets[key]
+	if !ok {
+		b = &bucket{
+			limiter: rate.NewLimiter(rate.Limit(kl.budget.Rate/60), kl.budget.Burst),
+		}
+		kl.buckets[key] = b
+	}
+	b.lastSeen = now
+	kl.mu.Unlock()
+
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return nil, time.Minute
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return nil, delay
+	}
+	return r, 0
+}
+
+func (kl *keyedLimiter) forgetIdle(now time.Time) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	for key, b := range kl.buckets {
+		if now.Sub(b.lastSeen) > idleTimeout {
+			delete(kl.buckets, key)
+		}
+	}
+}
+
+// Limits are the rate limits applied to the submission endpoints
+type Limits struct {
+	limiters map[string]*keyedLimiter
+	stop     chan struct{}
+}
+
+func limiterKey(kind string, scope string) string {
+	return kind + "/" + scope
+}
+
+// New creates the limits from the budget of each kind and scope, keyed by
+// "kind/scope". Missing budgets are unlimited.
+func New(budgets map[string]Budget) *Limits {
+	l := &Limits{
+		limiters: make(map[string]*keyedLimiter),
+		stop:     make(chan struct{}),
+	}
+	for _, kind := range kinds {
+		for _, scope := range scopes {
+			key := limiterKey(kind, scope)
+			l.limiters[key] = newKeyedLimiter(budgets[key])
+		}
+	}
+	return l
+}
+
+// FromConfig creates the limits from the rate-limit section of the config.
+// It returns nil when rate limiting is disabled.
+func FromConfig(cfg config.RateLimit) *Limits {
+	if !cfg.Enabled {
+		return nil
+	}
+	budgets := make(map[string]Budget)
+	for kind, b := range map[string]config.RateBudgets{
+		KindCreate: cfg.Create,
+		KindSubmit: cfg.Submit,
+	} {
+		budgets[limiterKey(kind, ScopeIP)] = Budget(b.IP)
+		budgets[limiterKey(kind, ScopeASN)] = Budget(b.ASN)
+		budgets[limiterKey(kind, ScopeGlobal)] = Budget(b.Global)
+	}
+	return New(budgets)
+}
+
+// Start periodically forgets the buckets of idle clients until Stop is
+// called
+func (l *Limits) Start() {
+	go func() {
+		ticker := time.NewTicker(idleTimeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, kl := range l.limiters {
+					kl.forgetIdle(now)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the goroutine started by Start. It's a no-op on nil limits.
+func (l *Limits) Stop() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+}
+
+// budget is one of the budgets of a kind a request is subject to
+type budget struct {
+	scope string
+	key   string
+}
+
+// allow takes a token from each of the budgets of kind. If one of them is
+// exhausted the tokens already taken are given back, so that a request
+// refused by the global budget doesn't count against its client, and the
+// 429 response is written.
+func (l *Limits) allow(c *gin.Context, kind string, budgets ...budget) bool {
+	now := time.Now()
+	var taken []*rate.Reservation
+	for _, b := range budgets {
+		// Over tor every client has the address of the local tor daemon
+		if b.scope == ScopeIP && transport.IsOnion(c.Request.Context()) {
+			continue
+		}
+		r, retryAfter := l.limiters[limiterKey(kind, b.scope)].reserve(b.key, now)
+		if retryAfter == 0 {
+			if r != nil {
+				taken = append(taken, r)
+			}
+			continue
+		}
+		for _, r := range taken {
+			r.CancelAt(now)
+		}
+		metrics.RateLimited.WithLabelValues(kind, b.scope).Inc()
+		logging.With(c.Request.Context(), log).WithFields(apexLog.Fields{
+			"kind":  kind,
+			"scope": b.scope,
+		}).Debug("rate limited")
+		c.Header("Retry-After", fmt.Sprintf("%d", int(math.Ceil(retryAfter.Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": "rate limit exceeded, retry later",
+		})
+		return false
+	}
+	return true
+}
+
+// Middleware applies the per client address and global budgets of kind
+// before the request body is read. The per ASN budget is applied by the
+// handlers with AllowASN once the body is parsed. Nil limits let every
+// request through.
+func (l *Limits) Middleware(kind string) gin.HandlerFunc {
+	if l == nil {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	return func(c *gin.Context) {
+		c.Set("RateLimits", l)
+		if l.allow(c, kind, budget{ScopeIP, c.ClientIP()}, budget{ScopeGlobal, ""}) != true {
+			return
+		}
+		c.Next()
+	}
+}
+
+func fromContext(c *gin.Context) *Limits {
+	l, ok := c.Get("RateLimits")
+	if !ok {
+		return nil
+	}
+	return l.(*Limits)
+}
+
+// AllowASN applies the per ASN budget of kind. When it's exhausted it
+// writes the 429 response and returns false.
+func AllowASN(c *gin.Context, kind string, asn string) bool {
+	l := fromContext(c)
+	if l == nil {
+		return true
+	}
+	return l.allow(c, kind, budget{ScopeASN, asn})
+}
+
+// Allow applies all the budgets of kind, for requests that are subject to
+// more than the budget of the endpoint (ex. a measurement creating a report)
+func Allow(c *gin.Context, kind string, asn string) bool {
+	l := fromContext(c)
+	if l == nil {
+		return true
+	}
+	return l.allow(c, kind, budget{ScopeIP, c.ClientIP()}, budget{ScopeGlobal, ""}, budget{ScopeASN, asn})
+}
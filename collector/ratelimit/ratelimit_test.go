@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/transport"
+)
+
+// send posts a measurement from addr, over tor if onion is set, with the
+// given probe_asn and returns the response
+func send(l *Limits, addr string, onion bool, asn string) *httptest.ResponseRecorder {
+	router := gin.New()
+	router.POST("/report/:reportID", l.Middleware(KindSubmit), func(c *gin.Context) {
+		if AllowASN(c, KindSubmit, asn) != true {
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest("POST", "/report/1", nil)
+	req.RemoteAddr = addr + ":1234"
+	if onion {
+		req = req.WithContext(transport.NewContext(req.Context(), transport.Onion))
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	l := New(map[string]Budget{
+		"submit/ip":     {Rate: 1, Burst: 2},
+		"submit/asn":    {Rate: 1, Burst: 3},
+		"submit/global": {Rate: 1, Burst: 7},
+	})
+	tests := []struct {
+		name  string
+		addr  string
+		onion bool
+		asn   string
+		want  int
+	}{
+		{"first", "192.0.2.1", false, "AS1", http.StatusOK},
+		{"second", "192.0.2.1", false, "AS1", http.StatusOK},
+		{"ip exhausted", "192.0.2.1", false, "AS1", http.StatusTooManyRequests},
+		{"other ip", "192.0.2.2", false, "AS1", http.StatusOK},
+		{"asn exhausted", "192.0.2.3", false, "AS1", http.StatusTooManyRequests},
+		{"other asn", "192.0.2.3", false, "AS2", http.StatusOK},
+		{"onion ignores the ip", "127.0.0.1", true, "AS3", http.StatusOK},
+		{"onion ignores the ip again", "127.0.0.1", true, "AS3", http.StatusOK},
+		{"global exhausted", "192.0.2.4", false, "AS4", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		w := send(l, tt.addr, tt.onion, tt.asn)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", tt.name)
+		}
+	}
+}
+
+func TestRefund(t *testing.T) {
+	l := New(map[string]Budget{
+		"submit/ip":     {Rate: 1, Burst: 1},
+		"submit/global": {Rate: 1, Burst: 1},
+	})
+	if w := send(l, "192.0.2.1", false, "AS1"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	// Refused by the global budget, the token of 192.0.2.2 is given back
+	if w := send(l, "192.0.2.2", false, "AS1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	r, delay := l.limiters["submit/ip"].reserve("192.0.2.2", time.Now())
+	if r == nil || delay != 0 {
+		t.Errorf("the ip token is not refunded, next in %s", delay)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	l := New(map[string]Budget{
+		"create/asn": {Rate: 1, Burst: 1},
+	})
+	var allowed []bool
+	router := gin.New()
+	router.POST("/measurement", l.Middleware(KindSubmit), func(c *gin.Context) {
+		allowed = append(allowed, Allow(c, KindCreate, "AS1"))
+	})
+	for i := 0; i < 2; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/measurement", nil))
+	}
+	if len(allowed) != 2 || !allowed[0] || allowed[1] {
+		t.Errorf("allowed = %v, want [true false]", allowed)
+	}
+}
+
+func TestNilLimits(t *testing.T) {
+	var l *Limits
+	for i := 0; i < 3; i++ {
+		if w := send(l, "192.0.2.1", false, "AS1"); w.Code != http.StatusOK {
+			t.Errorf("status = %d", w.Code)
+		}
+	}
+	l.Stop()
+}
+
+func TestForgetIdle(t *testing.T) {
+	kl := newKeyedLimiter(Budget{Rate: 1, Burst: 1})
+	now := time.Now()
+	kl.reserve("old", now.Add(-2*idleTimeout))
+	kl.reserve("new", now)
+	kl.forgetIdle(now)
+	if _, ok := kl.buckets["old"]; ok {
+		t.Error("the idle bucket is kept")
+	}
+	if _, ok := kl.buckets["new"]; !ok {
+		t.Error("the active bucket is forgotten")
+	}
+
+	l := New(nil)
+	l.Start()
+	l.Stop()
+}
@@ -0,0 +1,203 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ooni/collector/collector/durability"
+)
+
+const (
+	// benchReports is the number of reports the entries are spread over
+	benchReports = 16
+	// benchEntrySize is the size of an entry in bytes
+	benchEntrySize = 4096
+	// benchParallelism is the number of writers per CPU
+	benchParallelism = 4
+)
+
+// benchReportFiles creates n empty report files in a temporary folder. The
+// folder is created in $BENCH_DIR when set, to measure the disk of a data
+// root.
+func benchReportFiles(b *testing.B, n int) ([]string, func()) {
+	dir, err := ioutil.TempDir(os.Getenv("BENCH_DIR"), "bench-")
+	if err != nil {
+		b.Fatal(err)
+	}
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, fmt.Sprintf("report-%d", i))
+		if err = ioutil.WriteFile(paths[i], nil, 0700); err != nil {
+			os.RemoveAll(dir)
+			b.Fatal(err)
+		}
+	}
+	return paths, func() { os.RemoveAll(dir) }
+}
+
+// latencies collects the latency of the writes of the parallel writers
+type latencies struct {
+	mu     sync.Mutex
+	values []time.Duration
+}
+
+func (l *latencies) add(values []time.Duration) {
+	l.mu.Lock()
+	l.values = append(l.values, values...)
+	l.mu.Unlock()
+}
+
+// report reports the median and the 99th percentile of the latencies
+func (l *latencies) report(b *testing.B) {
+	sort.Slice(l.values, func(i, j int) bool { return l.values[i] < l.values[j] })
+	if n := len(l.values); n > 0 {
+		b.ReportMetric(float64(l.values[n/2].Nanoseconds()), "p50-ns")
+		b.ReportMetric(float64(l.values[n*99/100].Nanoseconds()), "p99-ns")
+	}
+}
+
+// runWrites calls write from benchParallelism writers per CPU, spreading the
+// writes over the reports, and reports the latency of the writes
+func runWrites(b *testing.B, paths []string, write func(i int, path string) error) {
+	var (
+		next int64
+		all  latencies
+	)
+	b.SetBytes(benchEntrySize)
+	b.SetParallelism(benchParallelism)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var mine []time.Duration
+		for pb.Next() {
+			i := int(atomic.AddInt64(&next, 1))
+			begin := time.Now()
+			if err := write(i, paths[i%len(paths)]); err != nil {
+				b.Error(err)
+				return
+			}
+			mine = append(mine, time.Since(begin))
+		}
+		all.add(mine)
+	})
+	b.StopTimer()
+	all.report(b)
+}
+
+// benchmarkWrites appends entries to the reports the way WriteEntry does,
+// keeping up to cache files open and making the entries durable with the
+// policy. Like WriteEntry the writers of a report take turns.
+func benchmarkWrites(b *testing.B, policy durability.Policy, cache int) {
+	paths, cleanup := benchReportFiles(b, benchReports)
+	defer cleanup()
+	entry := append(bytes.Repeat([]byte("x"), benchEntrySize-1), '\n')
+	files := newFileCache(cache)
+	defer files.closeAll()
+	syncer := durability.New(policy, 5*time.Millisecond)
+
+	runWrites(b, paths, func(i int, path string) error {
+		f, err := files.acquire(filepath.Base(path), path)
+		if err != nil {
+			return err
+		}
+		defer files.release(f)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if !f.verified {
+			if _, err = f.verify(); err != nil {
+				return err
+			}
+		}
+		return appendEntry(context.Background(), syncer, f, entry)
+	})
+	b.ReportMetric(float64(syncer.Syncs())/float64(b.N), "syncs/op")
+}
+
+// BenchmarkWrites compares the durability policies and the file cache sizes.
+// Run it with BENCH_DIR set to a folder of the data root to measure its disk:
+//
+//	BENCH_DIR=/var/ooni-collector go test -run - -bench Writes ./collector/report/
+func BenchmarkWrites(b *testing.B) {
+	for _, policy := range []durability.Policy{durability.None, durability.Fsync, durability.Group} {
+		for _, cache := range []int{0, 256} {
+			b.Run(fmt.Sprintf("policy=%s/cache=%d", policy, cache), func(b *testing.B) {
+				benchmarkWrites(b, policy, cache)
+			})
+		}
+	}
+}
+
+// benchEntry returns a measurement whose encoding is about benchEntrySize
+// bytes
+func benchEntry() *MeasurementEntry {
+	return &MeasurementEntry{
+		ReportID:          "20180601T100000Z_AS1_benchmark",
+		TestName:          "web_connectivity",
+		TestVersion:       "0.1.0",
+		DataFormatVersion: "0.2.0",
+		ProbeASN:          "AS1",
+		ProbeCC:           "IT",
+		SoftwareName:      "ooniprobe",
+		SoftwareVersion:   "2.0.0",
+		TestKeys: map[string]interface{}{
+			"body": string(bytes.Repeat([]byte("x"), benchEntrySize-512)),
+		},
+	}
+}
+
+// BenchmarkWritePath compares the write path of the collector before the
+// file cache and the index, which opened the report file and encoded the
+// entry into it for every measurement, with the current one. Neither syncs.
+func BenchmarkWritePath(b *testing.B) {
+	b.Run("baseline", func(b *testing.B) {
+		paths, cleanup := benchReportFiles(b, benchReports)
+		defer cleanup()
+		entry := benchEntry()
+		runWrites(b, paths, func(i int, path string) error {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0700)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return json.NewEncoder(f).Encode(entry)
+		})
+	})
+	for _, cache := range []int{0, 256} {
+		b.Run(fmt.Sprintf("cache=%d", cache), func(b *testing.B) {
+			paths, cleanup := benchReportFiles(b, benchReports)
+			defer cleanup()
+			entry := benchEntry()
+			files := newFileCache(cache)
+			defer files.closeAll()
+			syncer := durability.New(durability.None, 0)
+			runWrites(b, paths, func(i int, path string) error {
+				var buf bytes.Buffer
+				if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+					return err
+				}
+				f, err := files.acquire(filepath.Base(path), path)
+				if err != nil {
+					return err
+				}
+				defer files.release(f)
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				if !f.verified {
+					if _, err = f.verify(); err != nil {
+						return err
+					}
+				}
+				return appendEntry(context.Background(), syncer, f, buf.Bytes())
+			})
+		})
+	}
+}
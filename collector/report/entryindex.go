@@ -0,0 +1,148 @@
+package report
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// The index of a report file has a record per entry: the offset of the end
+// of the entry and its checksum. It's written after the entry, so an entry
+// cut short by a crash fails its check and is truncated.
+const indexRecordSize = 12
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// indexPath returns the path of the index of the report file at path
+func indexPath(path string) string {
+	return path + ".idx"
+}
+
+type indexRecord struct {
+	end int64
+	crc uint32
+}
+
+func newIndexRecord(end int64, entry []byte) indexRecord {
+	return indexRecord{end: end, crc: crc32.Checksum(entry, crcTable)}
+}
+
+func (r indexRecord) bytes() []byte {
+	b := make([]byte, indexRecordSize)
+	binary.BigEndian.PutUint64(b[:8], uint64(r.end))
+	binary.BigEndian.PutUint32(b[8:], r.crc)
+	return b
+}
+
+func (rf *reportFile) readRecord(i int64) (indexRecord, error) {
+	b := make([]byte, indexRecordSize)
+	if _, err := rf.index.ReadAt(b, i*indexRecordSize); err != nil {
+		return indexRecord{}, err
+	}
+	return indexRecord{
+		end: int64(binary.BigEndian.Uint64(b[:8])),
+		crc: binary.BigEndian.Uint32(b[8:]),
+	}, nil
+}
+
+// checkEntry tells whether the entry i of the index is whole in a report
+// file of size bytes and returns where it ends
+func (rf *reportFile) checkEntry(i int64, size int64) (bool, int64, error) {
+	rec, err := rf.readRecord(i)
+	if err != nil {
+		return false, 0, err
+	}
+	var start int64
+	if i > 0 {
+		prev, err := rf.readRecord(i - 1)
+		if err != nil {
+			return false, 0, err
+		}
+		start = prev.end
+	}
+	if rec.end <= start || rec.end > size {
+		return false, 0, nil
+	}
+	entry := make([]byte, rec.end-start)
+	if _, err = rf.ReadAt(entry, start); err != nil {
+		return false, 0, err
+	}
+	return newIndexRecord(rec.end, entry) == rec, rec.end, nil
+}
+
+// rebuildIndex indexes the complete lines of the report file, for the
+// reports written without an index, ex. before an upgrade or reopened once
+// closed. It returns the number of entries and where the last one ends.
+func (rf *reportFile) rebuildIndex(size int64) (int64, int64, error) {
+	var (
+		index   []byte
+		entries int64
+		end     int64
+	)
+	r := bufio.NewReader(io.NewSectionReader(rf.File, 0, size))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A last line without a newline is torn
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		end += int64(len(line))
+		entries++
+		index = append(index, newIndexRecord(end, line).bytes()...)
+	}
+	if err := rf.index.Truncate(0); err != nil {
+		return 0, 0, err
+	}
+	if _, err := rf.index.Write(index); err != nil {
+		return 0, 0, err
+	}
+	return entries, end, nil
+}
+
+// verify checks the end of the report file against its index, truncating a
+// torn entry and the index records of the entries missing from the file. It
+// returns the number of bytes truncated from the report file.
+func (rf *reportFile) verify() (int64, error) {
+	fi, err := rf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if fi, err = rf.index.Stat(); err != nil {
+		return 0, err
+	}
+	// A record cut short is ignored
+	entries := fi.Size() / indexRecordSize
+
+	// The entries before the last whole one made it to the disk before it
+	var end int64
+	for ; entries > 0; entries-- {
+		ok, entryEnd, err := rf.checkEntry(entries-1, size)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			end = entryEnd
+			break
+		}
+	}
+	if entries == 0 && size > 0 {
+		if entries, end, err = rf.rebuildIndex(size); err != nil {
+			return 0, err
+		}
+	}
+	if err = rf.index.Truncate(entries * indexRecordSize); err != nil {
+		return 0, err
+	}
+	if end < size {
+		if err = rf.Truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	rf.size, rf.entries, rf.verified = end, entries, true
+	return size - end, nil
+}
@@ -0,0 +1,263 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ooni/collector/collector/durability"
+)
+
+func entryLine(i int) string {
+	return fmt.Sprintf("{\"entry\": %d}\n", i)
+}
+
+// newIndexedReport writes n entries to a new report file through
+// appendEntry and closes it
+func newIndexedReport(t *testing.T, n int) (string, func()) {
+	dir, err := ioutil.TempDir("", "entryindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "report")
+	if err = ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openReportFile("report", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.verify(); err != nil {
+		t.Fatal(err)
+	}
+	syncer := durability.New(durability.None, 0)
+	for i := 0; i < n; i++ {
+		if err = appendEntry(context.Background(), syncer, f, []byte(entryLine(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func appendTo(t *testing.T, path string, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func truncate(t *testing.T, path string, size int64) {
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// verifyReport opens the report like the collector does and checks it
+// against its index
+func verifyReport(t *testing.T, path string) (*reportFile, int64) {
+	f, err := openReportFile("report", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := f.verify()
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f, truncated
+}
+
+// checkReport checks the report holds the first n entries and an index
+// record for each of them
+func checkReport(t *testing.T, path string, n int) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for i := 0; i < n; i++ {
+		want.WriteString(entryLine(i))
+	}
+	if string(data) != want.String() {
+		t.Errorf("report file = %q, want %q", data, want.String())
+	}
+	if size := fileSize(t, indexPath(path)); size != int64(n)*indexRecordSize {
+		t.Errorf("index size = %d, want %d", size, n*indexRecordSize)
+	}
+}
+
+func TestVerifyWholeReport(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != 0 || f.entries != 3 || f.size != fileSize(t, path) {
+		t.Errorf("truncated %d, %d entries, size %d", truncated, f.entries, f.size)
+	}
+	checkReport(t, path, 3)
+}
+
+func TestVerifyTornTail(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	appendTo(t, path, `{"entry": 3, "test_ke`)
+
+	f, truncated := verifyReport(t, path)
+	if truncated != int64(len(`{"entry": 3, "test_ke`)) || f.entries != 3 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	// The next entry follows the last whole one
+	err := appendEntry(context.Background(), durability.New(durability.None, 0), f, []byte(entryLine(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	checkReport(t, path, 4)
+
+	f, truncated = verifyReport(t, path)
+	defer f.Close()
+	if truncated != 0 || f.entries != 4 {
+		t.Errorf("after the repair: truncated %d, %d entries", truncated, f.entries)
+	}
+}
+
+func TestVerifyTornIndexRecord(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	// The crash happened while writing the record of the last entry
+	truncate(t, indexPath(path), 2*indexRecordSize+5)
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != int64(len(entryLine(2))) || f.entries != 2 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	checkReport(t, path, 2)
+}
+
+func TestVerifyIndexShorterThanFile(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	// The crash happened between the write of the entry and of its record
+	appendTo(t, path, entryLine(3))
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != int64(len(entryLine(3))) || f.entries != 3 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	checkReport(t, path, 3)
+}
+
+func TestVerifyIndexLongerThanFile(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	// The record of the last entry reached the disk, the entry didn't
+	truncate(t, path, fileSize(t, path)-4)
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != int64(len(entryLine(2))-4) || f.entries != 2 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	checkReport(t, path, 2)
+}
+
+func TestVerifyCorruptedEntry(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	// The last entry has the right length but not its content, ex. zeroes
+	size := fileSize(t, path)
+	truncate(t, path, size-int64(len(entryLine(2))))
+	truncate(t, path, size)
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != int64(len(entryLine(2))) || f.entries != 2 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	checkReport(t, path, 2)
+}
+
+func TestVerifyEmptyReport(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 0)
+	defer cleanup()
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != 0 || f.entries != 0 || f.size != 0 {
+		t.Errorf("truncated %d, %d entries, size %d", truncated, f.entries, f.size)
+	}
+	checkReport(t, path, 0)
+}
+
+func TestVerifyRebuildsIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// tail is written after the 3 whole entries
+		tail      string
+		truncated int64
+	}{
+		// Written by a collector without the index, or reopened once closed
+		{name: "whole", tail: ""},
+		{name: "torn", tail: `{"entry": 3`, truncated: int64(len(`{"entry": 3`))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := newIndexedReport(t, 3)
+			defer cleanup()
+			if err := os.Remove(indexPath(path)); err != nil {
+				t.Fatal(err)
+			}
+			appendTo(t, path, tt.tail)
+
+			f, truncated := verifyReport(t, path)
+			if truncated != tt.truncated || f.entries != 3 {
+				t.Errorf("truncated %d, %d entries", truncated, f.entries)
+			}
+			f.Close()
+			checkReport(t, path, 3)
+
+			// The rebuilt index is the one appendEntry writes
+			f, truncated = verifyReport(t, path)
+			defer f.Close()
+			if truncated != 0 || f.entries != 3 {
+				t.Errorf("with the rebuilt index: truncated %d, %d entries", truncated, f.entries)
+			}
+		})
+	}
+}
+
+func TestVerifyUnusableIndex(t *testing.T) {
+	path, cleanup := newIndexedReport(t, 3)
+	defer cleanup()
+	// No record of the index matches the file, it's rebuilt from the lines
+	if err := ioutil.WriteFile(indexPath(path), make([]byte, 3*indexRecordSize), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, truncated := verifyReport(t, path)
+	defer f.Close()
+	if truncated != 0 || f.entries != 3 {
+		t.Errorf("truncated %d, %d entries", truncated, f.entries)
+	}
+	checkReport(t, path, 3)
+}
@@ -4,3 +4,12 @@ import "errors"
 
 // ErrReportIsClosed indicates the report has already been closed
 var ErrReportIsClosed = errors.New("Report is already closed")
+
+// ErrInvalidProbeCC indicates the probe_cc of the entry is not a country code
+var ErrInvalidProbeCC = errors.New("Invalid probe_cc")
+
+// ErrReportIsOpen indicates the report has not been closed yet
+var ErrReportIsOpen = errors.New("Report is still open")
+
+// ErrReportFileMissing indicates the file backing a report is gone
+var ErrReportFileMissing = errors.New("Report file is missing")
@@ -0,0 +1,175 @@
+package report
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// reportFile is an open report file shared by the writers of the report,
+// along with its index
+type reportFile struct {
+	reportID string
+	*os.File
+	index *os.File
+	// mu serializes the writers of the report and guards the fields below
+	mu sync.Mutex
+	// verified tells whether the file has been checked against its index
+	// since it was opened, size and entries are only known then
+	verified bool
+	size     int64
+	entries  int64
+
+	// refs is the number of writers using the file, it's closed once
+	// evicted and no longer used
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+// fileCache keeps the most recently written report files open for
+// appending, so that a measurement doesn't cost an open and a close
+type fileCache struct {
+	size int
+
+	mu    sync.Mutex
+	idle  *sync.Cond
+	lru   *list.List
+	files map[string]*reportFile
+	// retiring are the reports being closed or purged, their file can't be
+	// opened until then
+	retiring map[string]bool
+}
+
+// newFileCache creates a cache keeping up to size files open. With a size of
+// 0 the files are opened for every write.
+func newFileCache(size int) *fileCache {
+	c := &fileCache{
+		size:     size,
+		lru:      list.New(),
+		files:    make(map[string]*reportFile),
+		retiring: make(map[string]bool),
+	}
+	c.idle = sync.NewCond(&c.mu)
+	return c
+}
+
+// acquire returns the open file of the report at path, opening it when it's
+// not cached. It must be released once written.
+func (c *fileCache) acquire(reportID string, path string) (*reportFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retiring[reportID] {
+		return nil, ErrReportIsClosed
+	}
+	if rf, ok := c.files[reportID]; ok {
+		rf.refs++
+		c.lru.MoveToFront(rf.elem)
+		return rf, nil
+	}
+
+	rf, err := openReportFile(reportID, path)
+	if err != nil {
+		return nil, err
+	}
+	rf.refs = 1
+	rf.elem = c.lru.PushFront(rf)
+	c.files[reportID] = rf
+	for c.lru.Len() > c.size {
+		c.evict(c.lru.Back().Value.(*reportFile))
+	}
+	return rf, nil
+}
+
+// openReportFile opens the report file at path and its index for appending,
+// creating the index if needed
+func openReportFile(reportID string, path string) (*reportFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0700)
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(indexPath(path), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &reportFile{reportID: reportID, File: f, index: index}, nil
+}
+
+// Close closes the report file and its index
+func (rf *reportFile) Close() error {
+	err := rf.File.Close()
+	if ierr := rf.index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// evict removes the file from the cache, closing it unless it's in use
+func (c *fileCache) evict(rf *reportFile) {
+	c.lru.Remove(rf.elem)
+	delete(c.files, rf.reportID)
+	rf.evicted = true
+	if rf.refs == 0 {
+		rf.Close()
+	}
+}
+
+// release hands back a file returned by acquire
+func (c *fileCache) release(rf *reportFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rf.refs--
+	if rf.refs > 0 {
+		return
+	}
+	if rf.evicted {
+		rf.Close()
+	}
+	c.idle.Broadcast()
+}
+
+// retire closes the file of the report once its writers are done and keeps
+// it from being opened again until done is called, ex. while it's renamed
+func (c *fileCache) retire(reportID string) (done func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retiring[reportID] = true
+	if rf, ok := c.files[reportID]; ok {
+		c.evict(rf)
+		for rf.refs > 0 {
+			c.idle.Wait()
+		}
+	}
+	return func() {
+		c.mu.Lock()
+		delete(c.retiring, reportID)
+		c.mu.Unlock()
+	}
+}
+
+// closeAll syncs and closes the cached files once their writers are done,
+// it's called on shutdown
+func (c *fileCache) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		rf := c.lru.Back().Value.(*reportFile)
+		if rf.refs > 0 {
+			c.idle.Wait()
+			continue
+		}
+		for _, f := range []*os.File{rf.File, rf.index} {
+			if err := f.Sync(); err != nil {
+				log.WithError(err).Errorf("failed to sync %s", f.Name())
+			}
+		}
+		c.evict(rf)
+	}
+}
+
+// CloseFiles syncs and closes the report files kept open. The files are
+// opened again by the next writes.
+func CloseFiles() {
+	openFiles().closeAll()
+}
@@ -1,36 +1,52 @@
 package report
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/apex/log"
+	apexLog "github.com/apex/log"
 	"github.com/ooni/collector/collector/aws"
+	"github.com/ooni/collector/collector/durability"
 	"github.com/ooni/collector/collector/info"
-	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/logging"
+	"github.com/ooni/collector/collector/metrics"
 	"github.com/ooni/collector/collector/storage"
+	"github.com/ooni/collector/collector/tracing"
+	"github.com/ooni/collector/collector/transport"
 	"github.com/ooni/collector/collector/util"
 	"github.com/rs/xid"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "report",
+	"cmd": "ooni-collector",
+})
+
 // expiryTimers is a map of timers keyed to the ReportID. These are used to
 // ensure that after a certain amount of time has elapsed reports are closed
 var expiryTimers = make(map[string]*time.Timer)
 
-// expiryTimeDuration is after how much time a report expires
-var expiryTimeDuration = time.Duration(8) * time.Hour
+// expiryTimersMu protects expiryTimers
+var expiryTimersMu sync.Mutex
 
 // BackendExtra is serverside extra metadata
 type BackendExtra struct {
 	SubmissionTime time.Time `json:"submission_time"`
 	MeasurementID  string    `json:"measurement_id"`
 	ReportID       string    `json:"report_id"`
+	// Transport is how the measurement reached the collector (https, onion
+	// or cloudfront)
+	Transport string `json:"transport"`
 }
 
 // MeasurementEntry is the structure of measurements submitted by an OONI Probe client
@@ -66,7 +82,7 @@ type MeasurementEntry struct {
 // closedReportPath is the final path of a report. The filename looks like this:
 // 20180601T172750Z-ndt-20180601T172754Z_AS14080_iR5R39aBde9hAcE6kMw7rOCAF0iR63IPSGtcMWYj0QDHHujaXu-AS14080-CO-probe-0.2.0.json
 func closedReportPath(meta *storage.ReportMetadata) string {
-	return filepath.Join(paths.ReportDir(), fmt.Sprintf(
+	return filepath.Join(reportDir(), fmt.Sprintf(
 		"%s-%s-%s-%s-%s-probe-0.2.0.json",
 		meta.CreationTime.Format(TimestampFormat),
 		meta.TestName,
@@ -90,9 +106,13 @@ func GenReportID(asn string) string {
 }
 
 // CreateNewReport creates a new report
-func CreateNewReport(store *storage.Storage, testName string, probeASN string, softwareName string, softwareVersion string) (string, error) {
+func CreateNewReport(ctx context.Context, store *storage.Storage, testName string, probeASN string, softwareName string, softwareVersion string) (string, error) {
+	ctx, span := tracing.StartSpan(ctx, "report.CreateNewReport",
+		attribute.String("test_name", testName))
+	defer span.End()
+
 	reportID := GenReportID(probeASN)
-	tmpPath := filepath.Join(paths.TempReportDir(), reportID)
+	tmpPath := filepath.Join(tempReportDir(), reportID)
 	meta := storage.ReportMetadata{
 		ReportID:        reportID,
 		TestName:        testName,
@@ -107,16 +127,61 @@ func CreateNewReport(store *storage.Storage, testName string, probeASN string, s
 		Closed:          false,
 		EntryCount:      0,
 	}
-	store.SetReport(&meta)
-	os.OpenFile(tmpPath, os.O_RDONLY|os.O_CREATE, 0700)
+	if err := store.SetReport(ctx, &meta); err != nil {
+		return "", err
+	}
+	if f, err := os.OpenFile(tmpPath, os.O_RDONLY|os.O_CREATE, 0700); err == nil {
+		f.Close()
+	}
+	if err := fileSyncer().SyncDir(tempReportDir()); err != nil {
+		logging.With(ctx, log).WithError(err).Error("failed to sync the temporary reports folder")
+	}
 
-	expiryTimers[reportID] = time.AfterFunc(expiryTimeDuration, func() {
-		CloseReport(store, reportID)
-	})
+	startExpiryTimer(store, reportID)
+	metrics.ReportsCreated.WithLabelValues(testName, transport.FromContext(ctx)).Inc()
 
 	return meta.ReportID, nil
 }
 
+// startExpiryTimer arms the timer that will close the report once it has
+// not been updated for core.report-expiry
+func startExpiryTimer(store *storage.Storage, reportID string) {
+	expiryTimersMu.Lock()
+	defer expiryTimersMu.Unlock()
+	if t, ok := expiryTimers[reportID]; ok {
+		t.Stop()
+	}
+	expiryTimers[reportID] = time.AfterFunc(currentSettings().expiry, func() {
+		meta, err := closeReport(context.Background(), store, reportID)
+		if err != nil {
+			log.WithError(err).Errorf("failed to close expired report %s", reportID)
+			return
+		}
+		metrics.ReportsExpired.WithLabelValues(meta.TestName).Inc()
+	})
+	metrics.OpenReports.Set(float64(len(expiryTimers)))
+}
+
+// resetExpiryTimer postpones the expiry of the report
+func resetExpiryTimer(reportID string) {
+	expiryTimersMu.Lock()
+	defer expiryTimersMu.Unlock()
+	if t, ok := expiryTimers[reportID]; ok {
+		t.Reset(currentSettings().expiry)
+	}
+}
+
+// stopExpiryTimer disarms and forgets the expiry timer of the report
+func stopExpiryTimer(reportID string) {
+	expiryTimersMu.Lock()
+	defer expiryTimersMu.Unlock()
+	if t, ok := expiryTimers[reportID]; ok {
+		t.Stop()
+		delete(expiryTimers, reportID)
+	}
+	metrics.OpenReports.Set(float64(len(expiryTimers)))
+}
+
 // SQSMessage is the message sent to SQS
 type SQSMessage struct {
 	ReportID     string
@@ -127,111 +192,358 @@ type SQSMessage struct {
 	CollectorFQN string
 }
 
-func sendMessageToSQS(meta *storage.ReportMetadata) {
+// observeSinkUpload records the outcome of shipping a report to a sink
+func observeSinkUpload(sink string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.SinkUploads.WithLabelValues(sink, result).Inc()
+	metrics.SinkUploadDuration.WithLabelValues(sink).Observe(time.Since(start).Seconds())
+}
+
+func sendMessageToSQS(ctx context.Context, meta *storage.ReportMetadata) (err error) {
+	_, span := tracing.StartSpan(ctx, "sink.sqs")
+	defer func() { tracing.EndSpan(span, err) }()
+
 	message := SQSMessage{
 		ReportID:     meta.ReportID,
 		TestName:     meta.TestName,
 		ReportFile:   filepath.Base(meta.ReportFilePath),
 		CreationTime: meta.CreationTime,
 		EntryCount:   meta.EntryCount,
-		CollectorFQN: viper.GetString("api.fqn"),
+		CollectorFQN: currentSettings().fqn,
 	}
 	value, err := json.Marshal(message)
 	if err != nil {
-		log.WithError(err).Error("failed to serialize meta")
-		return
+		logging.With(ctx, log).WithError(err).Error("failed to serialize meta")
+		return err
 	}
+	start := time.Now()
 	_, err = aws.SendMessage(aws.Session, string(value), "report")
+	observeSinkUpload("sqs", start, err)
 	if err != nil {
-		log.WithError(err).Error("failed to publish to aws SQS")
-		return
+		logging.With(ctx, log).WithError(err).Error("failed to publish to aws SQS")
+		return err
 	}
+	return nil
 }
 
-func uploadToS3(meta *storage.ReportMetadata) {
+func uploadToS3(ctx context.Context, meta *storage.ReportMetadata) (err error) {
+	_, span := tracing.StartSpan(ctx, "sink.s3")
+	defer func() { tracing.EndSpan(span, err) }()
+
 	filename := filepath.Base(meta.ReportFilePath)
-	bucket := viper.GetString("aws.s3-bucket")
+	cfg := currentSettings()
+	bucket := cfg.s3Bucket
 	prefix := fmt.Sprintf("%s/%s",
-		viper.GetString("aws.s3-prefix"),
+		cfg.s3Prefix,
 		time.Now().UTC().Format("2006-01-02"))
 	// We place files inside the directory $PREFIX/$YEAR-$MONTH-$DAY/
 	key := fmt.Sprintf("%s/%s", prefix, filename)
-	err := aws.UploadFile(aws.Session, meta.ReportFilePath, bucket, key)
+	start := time.Now()
+	err = aws.UploadFile(aws.Session, meta.ReportFilePath, bucket, key)
+	observeSinkUpload("s3", start, err)
 	if err != nil {
-		log.WithError(err).Errorf("failed to upload to s3://%s/%s", bucket, key)
-		return
+		logging.With(ctx, log).WithError(err).Errorf("failed to upload to s3://%s/%s", bucket, key)
+		return err
+	}
+	return nil
+}
+
+// errReportChanged indicates the report was reopened, purged or updated
+// while it was being uploaded
+var errReportChanged = errors.New("report changed during the upload")
+
+// UploadReport ships the closed report to the sinks and records the
+// outcome in its metadata. The report is shipped to every sink even when
+// one of them fails.
+func UploadReport(ctx context.Context, store *storage.Storage, meta *storage.ReportMetadata) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "report.UploadReport",
+		attribute.String("report_id", meta.ReportID))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	var failures []string
+	if serr := sendMessageToSQS(ctx, meta); serr != nil {
+		failures = append(failures, "sqs: "+serr.Error())
+	}
+	if serr := uploadToS3(ctx, meta); serr != nil {
+		failures = append(failures, "s3: "+serr.Error())
+	}
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, "; "))
+	}
+
+	// Only the upload fields are updated, and only if the report is still
+	// the one that was shipped
+	serr := store.UpdateReport(ctx, meta.ReportID, func(m *storage.ReportMetadata) error {
+		if m.Closed != true || m.EntryCount != meta.EntryCount ||
+			m.LastUpdateTime.Equal(meta.LastUpdateTime) != true {
+			return errReportChanged
+		}
+		if err != nil {
+			m.UploadAttempts++
+			m.UploadError = err.Error()
+		} else {
+			m.Uploaded = true
+			m.UploadTime = time.Now().UTC()
+			m.UploadError = ""
+		}
+		return nil
+	})
+	if serr == storage.ErrReportNotFound && err == nil {
+		// The metadata expired, ex. when uploaded by the backfill: only the
+		// tombstone records the upload, so that it's not uploaded twice
+		serr = store.MarkUploaded(ctx, meta)
 	}
+	if serr == errReportChanged || serr == storage.ErrReportNotFound {
+		logging.With(ctx, log).WithError(serr).Infof("not recording the upload status of %s", meta.ReportID)
+		serr = nil
+	}
+	if serr != nil {
+		logging.With(ctx, log).WithError(serr).Errorf("failed to record the upload status of %s", meta.ReportID)
+		if err == nil {
+			err = serr
+		}
+	}
+	return err
 }
 
-func performAWSTasks(meta *storage.ReportMetadata) {
-	sendMessageToSQS(meta)
-	uploadToS3(meta)
+// performAWSTasks ships the closed report in the background
+func performAWSTasks(ctx context.Context, store *storage.Storage, meta *storage.ReportMetadata) {
+	ctx, span := tracing.StartLinkedSpan(ctx, "report.performAWSTasks",
+		attribute.String("report_id", meta.ReportID))
+	defer span.End()
+
+	UploadReport(ctx, store, meta)
 }
 
 // CloseReport marks the report as closed and moves it into the final reports folder
-func CloseReport(store *storage.Storage, reportID string) error {
-	expiryTimers[reportID].Reset(expiryTimeDuration)
+func CloseReport(ctx context.Context, store *storage.Storage, reportID string) error {
+	_, err := closeReport(ctx, store, reportID)
+	return err
+}
+
+func closeReport(ctx context.Context, store *storage.Storage, reportID string) (meta *storage.ReportMetadata, err error) {
+	ctx, span := tracing.StartSpan(ctx, "report.CloseReport",
+		attribute.String("report_id", reportID))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	resetExpiryTimer(reportID)
+	// Wait for the writers of the report and close its file before moving it
+	done := openFiles().retire(reportID)
+	defer done()
 
-	meta, err := store.GetReport(reportID)
+	meta, err = store.GetReport(ctx, reportID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if meta.Closed == true {
-		return ErrReportIsClosed
+		return nil, ErrReportIsClosed
+	}
+
+	// The file is checked before it's closed for good
+	f, err := openReportFile(reportID, meta.ReportFilePath)
+	if err == nil {
+		err = checkReportFile(ctx, f, meta, "close")
+		f.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	dstPath := closedReportPath(meta)
 	if meta.EntryCount > 0 {
+		_, renameSpan := tracing.StartSpan(ctx, "report.rename")
 		err = os.Rename(meta.ReportFilePath, dstPath)
+		tracing.EndSpan(renameSpan, err)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	} else {
 		// There is no need to keep closed empty reports
 		os.Remove(meta.ReportFilePath)
 	}
+	// The index is only needed while the report is written
+	os.Remove(indexPath(meta.ReportFilePath))
+	// Make the rename durable before recording it. The report is already
+	// closed when it fails, it's only logged.
+	for _, dir := range []string{reportDir(), tempReportDir()} {
+		if err := fileSyncer().SyncDir(dir); err != nil {
+			logging.With(ctx, log).WithError(err).Errorf("failed to sync %s", dir)
+		}
+	}
 	meta.ReportFilePath = dstPath
 	meta.Closed = true
-	expiryTimers[reportID].Stop()
+	stopExpiryTimer(reportID)
 
-	if err = store.SetReport(meta); err != nil {
-		return err
+	if err = store.SetReport(ctx, meta); err != nil {
+		return nil, err
 	}
+	metrics.ReportsClosed.WithLabelValues(meta.TestName).Inc()
 	if aws.Session != nil {
-		go performAWSTasks(meta)
+		go performAWSTasks(ctx, store, meta)
+	}
+	return meta, nil
+}
+
+// CloseReportsOlderThan closes all the open reports that were created before
+// the cutoff and returns the IDs of the reports it closed
+func CloseReportsOlderThan(ctx context.Context, store *storage.Storage, cutoff time.Time) ([]string, error) {
+	reportList, err := store.FindReports(ctx, storage.Filter{State: storage.StateOpen})
+	if err != nil {
+		return nil, err
+	}
+	var closed []string
+	for _, meta := range reportList {
+		if meta.CreationTime.After(cutoff) {
+			continue
+		}
+		if err = CloseReport(ctx, store, meta.ReportID); err != nil {
+			logging.With(ctx, log).WithError(err).Errorf("failed to close %s", meta.ReportID)
+			continue
+		}
+		closed = append(closed, meta.ReportID)
+	}
+	return closed, nil
+}
+
+// ReopenReport moves a closed report back into the temporary reports folder
+// so that further entries can be appended to it
+func ReopenReport(ctx context.Context, store *storage.Storage, reportID string) error {
+	// Keep the file from being opened, ex. by a concurrent close, while it's
+	// moved
+	done := openFiles().retire(reportID)
+	defer done()
+
+	meta, err := store.GetReport(ctx, reportID)
+	if err != nil {
+		return err
+	}
+	if meta.Closed != true {
+		return ErrReportIsOpen
 	}
+
+	tmpPath := filepath.Join(tempReportDir(), reportID)
+	if _, err = os.Stat(meta.ReportFilePath); err == nil {
+		if err = os.Rename(meta.ReportFilePath, tmpPath); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) && meta.EntryCount == 0 {
+		// Empty reports are not kept when closed
+		f, err := os.OpenFile(tmpPath, os.O_RDONLY|os.O_CREATE, 0700)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	} else if os.IsNotExist(err) {
+		return ErrReportFileMissing
+	} else {
+		return err
+	}
+	for _, dir := range []string{reportDir(), tempReportDir()} {
+		if err := fileSyncer().SyncDir(dir); err != nil {
+			logging.With(ctx, log).WithError(err).Errorf("failed to sync %s", dir)
+		}
+	}
+	meta.ReportFilePath = tmpPath
+	meta.Closed = false
+	meta.LastUpdateTime = time.Now().UTC()
+	// The new entries have to be shipped once it's closed again
+	meta.Uploaded = false
+	meta.UploadTime = time.Time{}
+	meta.UploadAttempts = 0
+	meta.UploadError = ""
+
+	if err = store.SetReport(ctx, meta); err != nil {
+		return err
+	}
+	startExpiryTimer(store, reportID)
 	return nil
 }
 
+// PurgeReport removes every trace of a report: its file, be it open or
+// closed, and its metadata
+func PurgeReport(ctx context.Context, store *storage.Storage, reportID string) error {
+	meta, err := store.GetReport(ctx, reportID)
+	if err != nil {
+		return err
+	}
+	stopExpiryTimer(reportID)
+
+	done := openFiles().retire(reportID)
+	defer done()
+	err = os.Remove(meta.ReportFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(indexPath(meta.ReportFilePath))
+	return store.DeleteReport(ctx, reportID)
+}
+
 func genMeasurementID() string {
 	return xid.New().String()
 }
 
-func addBackendExtra(meta *storage.ReportMetadata, entry *MeasurementEntry) string {
+func addBackendExtra(ctx context.Context, meta *storage.ReportMetadata, entry *MeasurementEntry) string {
 	measurementID := genMeasurementID()
 	entry.BackendVersion = info.Version
 	entry.BackendExtra.SubmissionTime = meta.LastUpdateTime
 	entry.BackendExtra.ReportID = meta.ReportID
 	entry.BackendExtra.MeasurementID = measurementID
+	entry.BackendExtra.Transport = transport.FromContext(ctx)
 	return measurementID
 }
 
 var probeCCRegexp = regexp.MustCompile("^[A-Z]{2}$")
 
 // WriteEntry will write an entry to report
-func WriteEntry(store *storage.Storage, reportID string, entry *MeasurementEntry) (string, *storage.ReportMetadata, error) {
-	expiryTimers[reportID].Reset(expiryTimeDuration)
+func WriteEntry(ctx context.Context, store *storage.Storage, reportID string, entry *MeasurementEntry) (measurementID string, meta *storage.ReportMetadata, err error) {
+	ctx, span := tracing.StartSpan(ctx, "report.WriteEntry",
+		attribute.String("report_id", reportID))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	resetExpiryTimer(reportID)
+
+	// Only the files of the open reports are opened
+	meta, err = store.GetReport(ctx, reportID)
+	if err != nil {
+		return "", nil, err
+	}
+	if meta.Closed == true {
+		return "", nil, ErrReportIsClosed
+	}
+
+	// The writers of a report take turns on its file, from reading the
+	// metadata to writing it back
+	f, err := openFiles().acquire(reportID, meta.ReportFilePath)
+	if os.IsNotExist(err) {
+		err = ErrReportFileMissing
+		// It was moved if the report has been closed in the meantime
+		if meta, gerr := store.GetReport(ctx, reportID); gerr == nil && meta.Closed == true {
+			err = ErrReportIsClosed
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	defer openFiles().release(f)
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	meta, err := store.GetReport(reportID)
+	meta, err = store.GetReport(ctx, reportID)
 	if err != nil {
 		return "", nil, err
 	}
 	if meta.Closed == true {
 		return "", nil, ErrReportIsClosed
 	}
+	if err = checkReportFile(ctx, f, meta, "open"); err != nil {
+		return "", nil, err
+	}
 	if meta.ProbeCC == "" {
 		if probeCCRegexp.MatchString(entry.ProbeCC) != true {
-			return "", nil, errors.New("Invalid probe_cc")
+			return "", nil, ErrInvalidProbeCC
 		}
 		meta.ProbeCC = entry.ProbeCC
 	}
@@ -243,43 +555,136 @@ func WriteEntry(store *storage.Storage, reportID string, entry *MeasurementEntry
 		}
 	}
 	meta.LastUpdateTime = time.Now().UTC()
-	meta.EntryCount++
-	measurementID := addBackendExtra(meta, entry)
+	measurementID = addBackendExtra(ctx, meta, entry)
 
-	f, err := os.OpenFile(meta.ReportFilePath, os.O_APPEND|os.O_WRONLY, 0700)
+	var buf bytes.Buffer
+	_, encodeSpan := tracing.StartSpan(ctx, "report.encode")
+	enc := json.NewEncoder(&buf)
+	err = enc.Encode(entry)
+	tracing.EndSpan(encodeSpan, err)
 	if err != nil {
+		logging.With(ctx, log).WithError(err).Error("Failed to encode measurement entry")
 		return "", nil, err
 	}
-	defer f.Close()
 
-	enc := json.NewEncoder(f)
-	err = enc.Encode(entry)
-	if err != nil {
-		log.WithError(err).Error("Failed to encode measurement entry")
+	if err = appendEntry(ctx, fileSyncer(), f, buf.Bytes()); err != nil {
 		return "", nil, err
 	}
+	meta.EntryCount = f.entries
 
-	if err = store.SetReport(meta); err != nil {
+	if err = store.SetReport(ctx, meta); err != nil {
 		return "", nil, err
 	}
 
 	return measurementID, meta, nil
 }
 
+// appendEntry appends the encoded entry to the report file and its index and
+// makes them durable with syncer. The caller holds the lock of the file and
+// has verified it.
+func appendEntry(ctx context.Context, syncer *durability.Syncer, f *reportFile, data []byte) (err error) {
+	_, span := tracing.StartSpan(ctx, "report.append",
+		attribute.Int("entry_size", len(data)))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	start := time.Now()
+	end := f.size + int64(len(data))
+	_, err = f.Write(data)
+	if err == nil {
+		_, err = f.index.Write(newIndexRecord(end, data).bytes())
+	}
+	if err == nil {
+		_, syncSpan := tracing.StartSpan(ctx, "report.sync")
+		err = syncer.SyncFiles(f.File, f.index)
+		tracing.EndSpan(syncSpan, err)
+	}
+	if err != nil {
+		logging.With(ctx, log).WithError(err).Error("Failed to write measurement entry")
+		// Don't leave a partial or unsynced line behind (ex. when the disk
+		// is full), the probe will submit it again
+		if terr := f.Truncate(f.size); terr != nil {
+			logging.With(ctx, log).WithError(terr).Error("Failed to truncate partial measurement entry")
+		}
+		if terr := f.index.Truncate(f.entries * indexRecordSize); terr != nil {
+			logging.With(ctx, log).WithError(terr).Error("Failed to truncate the report index")
+		}
+		return err
+	}
+	f.size = end
+	f.entries++
+	metrics.EntryWriteDuration.Observe(time.Since(start).Seconds())
+	metrics.EntrySize.Observe(float64(len(data)))
+	return nil
+}
+
+// checkReportFile verifies the report file once it's opened, truncating the
+// entry a crash left torn, and reconciles the entry count of meta with the
+// entries of the file. stage tells whether the report is being written or
+// closed.
+func checkReportFile(ctx context.Context, f *reportFile, meta *storage.ReportMetadata, stage string) error {
+	if f.verified {
+		return nil
+	}
+	truncated, err := f.verify()
+	if err != nil {
+		logging.With(ctx, log).WithError(err).Errorf("failed to verify %s", f.Name())
+		return err
+	}
+	if truncated > 0 {
+		logging.With(ctx, log).WithFields(apexLog.Fields{
+			"report_id": meta.ReportID,
+			"truncated": truncated,
+			"stage":     stage,
+		}).Warn("truncated a torn measurement entry")
+		metrics.TornEntries.WithLabelValues(stage).Inc()
+		if err = fileSyncer().SyncFiles(f.File, f.index); err != nil {
+			return err
+		}
+	}
+	if f.entries != meta.EntryCount {
+		logging.With(ctx, log).WithFields(apexLog.Fields{
+			"report_id":   meta.ReportID,
+			"entry_count": meta.EntryCount,
+			"entries":     f.entries,
+		}).Warn("entry count doesn't match the report file, reconciled")
+		meta.EntryCount = f.entries
+	}
+	return nil
+}
+
 // ReloadExpiryTimers is used to reload the timers for reports to expire
 func ReloadExpiryTimers(store *storage.Storage) error {
-	reportList, err := store.ListReports()
+	reportList, err := store.FindReports(context.Background(), storage.Filter{State: storage.StateOpen})
 	if err != nil {
 		log.WithError(err).Error("failed to list reports")
 		return err
 	}
 
 	// We setup the timers so that pending reports will expire the
-	// ExpiryTimeDuration after the server has been rebooted
+	// core.report-expiry after the server has been rebooted
 	for _, meta := range reportList {
-		expiryTimers[meta.ReportID] = time.AfterFunc(expiryTimeDuration, func() {
-			CloseReport(store, meta.ReportID)
-		})
+		startExpiryTimer(store, meta.ReportID)
 	}
 	return nil
 }
+
+// WatchMetadataExpiry closes the open reports whose metadata is about to
+// expire, which would leave their temporary file behind, and logs the closed
+// ones so that the pipeline can audit them first
+func WatchMetadataExpiry(store *storage.Storage) {
+	store.OnExpiry(func(ctx context.Context, meta *storage.ReportMetadata, expiresAt time.Time) {
+		entry := log.WithFields(apexLog.Fields{
+			"report_id":  meta.ReportID,
+			"expires_at": expiresAt,
+			"uploaded":   meta.Uploaded,
+		})
+		if meta.Closed == true {
+			entry.Info("metadata of closed report about to expire")
+			return
+		}
+		entry.Warn("closing open report whose metadata is about to expire")
+		if _, err := closeReport(ctx, store, meta.ReportID); err != nil {
+			entry.WithError(err).Error("failed to close report")
+		}
+	})
+}
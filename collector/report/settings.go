@@ -0,0 +1,85 @@
+package report
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/durability"
+	"github.com/ooni/collector/collector/paths"
+)
+
+// settings are the parts of the configuration the reports depend on that
+// can change on reload
+type settings struct {
+	dataRoot string
+	// expiry is how long an open report is kept without updates
+	expiry   time.Duration
+	fqn      string
+	s3Bucket string
+	s3Prefix string
+}
+
+var (
+	current atomic.Value
+	// files and policySyncer are set by Init, their settings only change on
+	// restart
+	files        *fileCache
+	policySyncer *durability.Syncer
+)
+
+// Init sets up the data root, the cache of the report files and the
+// durability policy, then applies the rest of cfg like Configure. It must be called before
+// handling reports.
+func Init(cfg *config.Config) error {
+	policy, err := durability.ParsePolicy(cfg.Durability.Policy)
+	if err != nil {
+		return err
+	}
+	policySyncer = durability.New(policy, cfg.Durability.GroupCommitInterval)
+	files = newFileCache(cfg.Core.ReportFileCache)
+	current.Store(settings{dataRoot: cfg.Core.DataRoot})
+	Configure(cfg)
+	return nil
+}
+
+// Configure applies the settings of cfg that can change at runtime, ex. on
+// reload. The data root only changes on Init.
+func Configure(cfg *config.Config) {
+	s := settings{
+		dataRoot: cfg.Core.DataRoot,
+		expiry:   cfg.Core.ReportExpiry,
+		fqn:      cfg.API.FQN,
+		s3Bucket: cfg.AWS.S3Bucket,
+		s3Prefix: cfg.AWS.S3Prefix,
+	}
+	if prev, ok := current.Load().(settings); ok {
+		s.dataRoot = prev.dataRoot
+	}
+	current.Store(s)
+}
+
+func currentSettings() settings {
+	return current.Load().(settings)
+}
+
+// openFiles returns the cache of the report files, sized by
+// core.report-file-cache
+func openFiles() *fileCache {
+	return files
+}
+
+// fileSyncer returns the syncer of the durability policy in use
+func fileSyncer() *durability.Syncer {
+	return policySyncer
+}
+
+// reportDir is the folder of the closed reports
+func reportDir() string {
+	return paths.ReportDir(currentSettings().dataRoot)
+}
+
+// tempReportDir is the folder of the open reports
+func tempReportDir() string {
+	return paths.TempReportDir(currentSettings().dataRoot)
+}
@@ -0,0 +1,131 @@
+package report
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ooni/collector/collector/storage"
+)
+
+// closedReportRegexp matches the names given by closedReportPath
+var closedReportRegexp = regexp.MustCompile(
+	`^(\d{8}T\d{6}Z)-(.+)-(\d{8}T\d{6}Z_[^-]+)-([^-]*)-([A-Z]{0,2})-probe-0\.2\.0\.json$`)
+
+// countEntries returns the number of measurements in a report file
+func countEntries(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count int64
+	r := bufio.NewReader(f)
+	for {
+		_, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// ReportIDFromPath returns the ID of the report of a closed report file, or
+// an empty string when path is not named like one
+func ReportIDFromPath(path string) string {
+	m := closedReportRegexp.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return ""
+	}
+	return m[3]
+}
+
+// metadataFromFile rebuilds the metadata of a closed report file whose
+// metadata is no longer in the store, ex. because it expired
+func metadataFromFile(path string) (*storage.ReportMetadata, error) {
+	m := closedReportRegexp.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return nil, nil
+	}
+	creationTime, err := time.Parse(TimestampFormat, m[1])
+	if err != nil {
+		return nil, nil
+	}
+	entryCount, err := countEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.ReportMetadata{
+		ReportID:       m[3],
+		TestName:       m[2],
+		ProbeASN:       m[4],
+		ProbeCC:        m[5],
+		ReportFilePath: path,
+		CreationTime:   creationTime,
+		LastUpdateTime: creationTime,
+		EntryCount:     entryCount,
+		Closed:         true,
+	}, nil
+}
+
+// PendingUploads returns the closed report files that have not reached the
+// sinks yet, or all of them with all set, the oldest first. Files whose
+// metadata has expired are included with the metadata rebuilt from their
+// name and content, unless their tombstone records they were uploaded.
+func PendingUploads(ctx context.Context, store *storage.Storage, all bool) ([]*storage.ReportMetadata, error) {
+	infos, err := ioutil.ReadDir(reportDir())
+	if err != nil {
+		return nil, err
+	}
+	reportList, err := store.FindReports(ctx, storage.Filter{State: storage.StateClosed})
+	if err != nil {
+		return nil, err
+	}
+	metaByPath := make(map[string]*storage.ReportMetadata)
+	for _, meta := range reportList {
+		metaByPath[meta.ReportFilePath] = meta
+	}
+
+	var pending []*storage.ReportMetadata
+	for _, info := range infos {
+		if info.Mode().IsRegular() != true {
+			continue
+		}
+		path := filepath.Join(reportDir(), info.Name())
+		meta, ok := metaByPath[path]
+		if !ok {
+			if meta, err = metadataFromFile(path); err != nil {
+				return nil, err
+			}
+			if meta == nil {
+				log.Warnf("skipping %s, not a report file", path)
+				continue
+			}
+			// The tombstone tells whether it was uploaded before
+			if t, err := store.GetTombstone(ctx, meta.ReportID); err == nil {
+				meta.Uploaded = t.Uploaded
+			}
+		}
+		if meta.Uploaded == true && all != true {
+			continue
+		}
+		pending = append(pending, meta)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreationTime.Before(pending[j].CreationTime)
+	})
+	return pending, nil
+}
@@ -0,0 +1,237 @@
+package retention
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	apexLog "github.com/apex/log"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/metrics"
+	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/report"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/ooni/collector/collector/util"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "retention",
+	"cmd": "ooni-collector",
+})
+
+// diskUsage measures the filesystem of the data root, the tests replace it
+var diskUsage = util.DiskUsage
+
+const (
+	reasonUploaded  = "uploaded"
+	reasonAge       = "age"
+	reasonDiskUsage = "disk-usage"
+)
+
+// Policy describes when closed report files can be deleted
+type Policy struct {
+	// DryRun only logs what would be deleted
+	DryRun bool
+	// DeleteAfterUpload deletes files once they reached all the sinks
+	DeleteAfterUpload bool
+	// MaxAge deletes files older than it. Zero disables it.
+	MaxAge time.Duration
+	// MaxDiskUsage is the percentage of the data root filesystem above
+	// which the oldest uploaded files are deleted. Zero disables it.
+	MaxDiskUsage float64
+	// DeleteNotUploaded lets MaxDiskUsage delete the files not uploaded
+	// yet, once the uploaded ones are gone
+	DeleteNotUploaded bool
+}
+
+// PolicyFromConfig builds the retention policy from the retention section
+// of the configuration
+func PolicyFromConfig(cfg config.Retention) Policy {
+	return Policy{
+		DryRun:            cfg.DryRun,
+		DeleteAfterUpload: cfg.DeleteAfterUpload,
+		MaxAge:            time.Duration(cfg.MaxAgeDays) * 24 * time.Hour,
+		MaxDiskUsage:      cfg.MaxDiskUsage,
+		DeleteNotUploaded: cfg.DeleteNotUploaded,
+	}
+}
+
+type reportFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	// uploaded is set once the report reached all the sinks
+	uploaded bool
+}
+
+// listReportFiles returns the closed report files of the data root sorted
+// from the oldest to the newest. Whether they were uploaded is read from
+// their metadata or, once it expired, from their tombstone.
+func listReportFiles(store *storage.Storage, dataRoot string) ([]*reportFile, error) {
+	reportDir := paths.ReportDir(dataRoot)
+	infos, err := ioutil.ReadDir(reportDir)
+	if err != nil {
+		return nil, err
+	}
+	reportList, err := store.FindReports(context.Background(), storage.Filter{State: storage.StateClosed})
+	if err != nil {
+		return nil, err
+	}
+	metaByPath := make(map[string]*storage.ReportMetadata)
+	for _, meta := range reportList {
+		metaByPath[meta.ReportFilePath] = meta
+	}
+
+	var files []*reportFile
+	for _, info := range infos {
+		if info.Mode().IsRegular() != true {
+			continue
+		}
+		path := filepath.Join(reportDir, info.Name())
+		f := &reportFile{
+			path:    path,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+		if meta, ok := metaByPath[path]; ok {
+			f.uploaded = meta.Uploaded
+		} else if reportID := report.ReportIDFromPath(path); reportID != "" {
+			t, err := store.GetTombstone(context.Background(), reportID)
+			if err != nil && err != storage.ErrReportNotFound {
+				return nil, err
+			}
+			f.uploaded = err == nil && t.Uploaded
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	return files, nil
+}
+
+func (p Policy) deleteFile(f *reportFile, reason string) error {
+	ctx := log.WithFields(apexLog.Fields{
+		"path":   f.path,
+		"size":   f.size,
+		"reason": reason,
+	})
+	if p.DryRun == true {
+		ctx.Info("would delete report file (dry-run)")
+		return nil
+	}
+	if err := os.Remove(f.path); err != nil {
+		ctx.WithError(err).Error("failed to delete report file")
+		return err
+	}
+	ctx.Info("deleted report file")
+	metrics.RetentionFilesDeleted.WithLabelValues(reason).Inc()
+	metrics.RetentionBytesReclaimed.WithLabelValues(reason).Add(float64(f.size))
+	return nil
+}
+
+// Sweep applies the policy once to the closed report files of the data root
+func (p Policy) Sweep(store *storage.Storage, dataRoot string) error {
+	files, err := listReportFiles(store, dataRoot)
+	if err != nil {
+		return err
+	}
+
+	var remaining []*reportFile
+	now := time.Now()
+	for _, f := range files {
+		reason := ""
+		if p.DeleteAfterUpload == true && f.uploaded == true {
+			reason = reasonUploaded
+		} else if p.MaxAge > 0 && now.Sub(f.modTime) > p.MaxAge {
+			reason = reasonAge
+		}
+		if reason == "" {
+			remaining = append(remaining, f)
+			continue
+		}
+		if p.deleteFile(f, reason) != nil {
+			remaining = append(remaining, f)
+		}
+	}
+
+	if p.MaxDiskUsage <= 0 {
+		return nil
+	}
+	total, avail, err := diskUsage(dataRoot)
+	if err != nil || total == 0 {
+		return err
+	}
+	used := total - avail
+	// remaining is sorted oldest first, so the oldest files go first, the
+	// uploaded ones before the others
+	for _, uploaded := range []bool{true, false} {
+		if !uploaded && !p.DeleteNotUploaded {
+			break
+		}
+		for _, f := range remaining {
+			if float64(used)*100/float64(total) <= p.MaxDiskUsage {
+				return nil
+			}
+			if f.uploaded != uploaded {
+				continue
+			}
+			if p.deleteFile(f, reasonDiskUsage) == nil {
+				used -= uint64(f.size)
+			}
+		}
+	}
+	return nil
+}
+
+// Sweeper applies the retention policy periodically
+type Sweeper struct {
+	policy atomic.Value
+	stop   chan struct{}
+}
+
+// Start periodically applies the retention policy of cfg to the data root
+// in the background. It does nothing and returns nil unless retention is
+// enabled.
+func Start(store *storage.Storage, dataRoot string, cfg config.Retention) *Sweeper {
+	if !cfg.Enabled {
+		return nil
+	}
+	s := &Sweeper{stop: make(chan struct{})}
+	s.Update(cfg)
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			if err := s.policy.Load().(Policy).Sweep(store, dataRoot); err != nil {
+				log.WithError(err).Error("retention sweep failed")
+			}
+		}
+	}()
+	return s
+}
+
+// Update changes the policy applied by the next sweeps, ex. on reload
+func (s *Sweeper) Update(cfg config.Retention) {
+	if s == nil {
+		return
+	}
+	s.policy.Store(PolicyFromConfig(cfg))
+}
+
+// Stop stops the sweeps
+func (s *Sweeper) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+}
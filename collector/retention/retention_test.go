@@ -0,0 +1,217 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/paths"
+	"github.com/ooni/collector/collector/storage"
+	"github.com/spf13/viper"
+)
+
+// newDataRoot creates a data root with an open store
+func newDataRoot(t *testing.T) (string, *storage.Storage, func()) {
+	dir, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(paths.ReportDir(dir), 0700); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	config.SetDefaults(v)
+	v.Set("core.is-dev", true)
+	v.Set("core.data-root", dir)
+	cfg, err := config.Load(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.New(paths.BadgerDir(dir), cfg.Store)
+	if err = store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// reportState is how a closed report file is known to the store
+type reportState int
+
+const (
+	// notUploaded has metadata that is not uploaded
+	notUploaded reportState = iota
+	// uploaded has metadata that is uploaded
+	uploaded
+	// expiredUploaded only has a tombstone recording its upload
+	expiredUploaded
+	// unknown is not in the store
+	unknown
+)
+
+// addReport writes a closed report file named name, modified age ago, and
+// records it in the store
+func addReport(t *testing.T, dir string, store *storage.Storage, name string, age time.Duration, state reportState) {
+	reportID := fmt.Sprintf("20180601T100000Z_AS1_%s", name)
+	path := filepath.Join(paths.ReportDir(dir),
+		fmt.Sprintf("20180601T100000Z-web_connectivity-%s-AS1-IT-probe-0.2.0.json", reportID))
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	meta := &storage.ReportMetadata{
+		ReportID:       reportID,
+		TestName:       "web_connectivity",
+		ProbeASN:       "AS1",
+		ProbeCC:        "IT",
+		ReportFilePath: path,
+		CreationTime:   modTime,
+		LastUpdateTime: modTime,
+		EntryCount:     1,
+		Closed:         true,
+		Uploaded:       state == uploaded,
+	}
+	var err error
+	switch state {
+	case notUploaded, uploaded:
+		err = store.SetReport(context.Background(), meta)
+	case expiredUploaded:
+		err = store.MarkUploaded(context.Background(), meta)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// remaining returns the names of the reports whose file is left
+func remaining(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(paths.ReportDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		var name string
+		fmt.Sscanf(info.Name(), "20180601T100000Z-web_connectivity-20180601T100000Z_AS1_%s", &name)
+		names = append(names, strings.TrimSuffix(name, "-AS1-IT-probe-0.2.0.json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSweep(t *testing.T) {
+	// The usage of any filesystem is above it
+	const full = 1e-9
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{name: "nothing enabled", want: "[expired new notuploaded old unknown uploaded]"},
+		{
+			name:   "after upload",
+			policy: Policy{DeleteAfterUpload: true},
+			want:   "[new notuploaded old unknown]",
+		},
+		{
+			name:   "age",
+			policy: Policy{MaxAge: 24 * time.Hour},
+			want:   "[expired new notuploaded unknown uploaded]",
+		},
+		{
+			name:   "disk usage",
+			policy: Policy{MaxDiskUsage: full},
+			want:   "[new notuploaded old unknown]",
+		},
+		{
+			name:   "disk usage deleting the files not uploaded",
+			policy: Policy{MaxDiskUsage: full, DeleteNotUploaded: true},
+			want:   "[]",
+		},
+		{
+			name:   "dry-run",
+			policy: Policy{DryRun: true, DeleteAfterUpload: true, MaxAge: time.Hour, MaxDiskUsage: full, DeleteNotUploaded: true},
+			want:   "[expired new notuploaded old unknown uploaded]",
+		},
+	}
+	for _, tt := range tests {
+		dir, store, cleanup := newDataRoot(t)
+		addReport(t, dir, store, "new", time.Minute, notUploaded)
+		addReport(t, dir, store, "old", 48*time.Hour, notUploaded)
+		addReport(t, dir, store, "notuploaded", time.Hour, notUploaded)
+		addReport(t, dir, store, "uploaded", time.Hour, uploaded)
+		addReport(t, dir, store, "expired", time.Hour, expiredUploaded)
+		addReport(t, dir, store, "unknown", time.Hour, unknown)
+
+		if err := tt.policy.Sweep(store, dir); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got := fmt.Sprint(remaining(t, dir)); got != tt.want {
+			t.Errorf("%s: left %s, want %s", tt.name, got, tt.want)
+		}
+		cleanup()
+	}
+}
+
+func TestSweepDiskUsageOrder(t *testing.T) {
+	// Each file is 3 bytes of a 100 bytes filesystem. a is the oldest but
+	// is not uploaded, c only has its tombstone.
+	defer func(f func(string) (uint64, uint64, error)) { diskUsage = f }(diskUsage)
+	tests := []struct {
+		name   string
+		policy Policy
+		want   string
+	}{
+		{
+			// 9% used, the oldest uploaded file goes first
+			name:   "one file",
+			policy: Policy{MaxDiskUsage: 7},
+			want:   "[a c]",
+		},
+		{
+			name:   "all the uploaded files",
+			policy: Policy{MaxDiskUsage: 1},
+			want:   "[a]",
+		},
+		{
+			name:   "then the others",
+			policy: Policy{MaxDiskUsage: 1, DeleteNotUploaded: true},
+			want:   "[]",
+		},
+		{
+			name:   "uploaded files are enough",
+			policy: Policy{MaxDiskUsage: 4, DeleteNotUploaded: true},
+			want:   "[a]",
+		},
+	}
+	for _, tt := range tests {
+		dir, store, cleanup := newDataRoot(t)
+		addReport(t, dir, store, "a", 3*time.Hour, notUploaded)
+		addReport(t, dir, store, "b", 2*time.Hour, uploaded)
+		addReport(t, dir, store, "c", time.Hour, expiredUploaded)
+		diskUsage = func(path string) (uint64, uint64, error) {
+			infos, err := ioutil.ReadDir(paths.ReportDir(path))
+			return 100, 100 - 3*uint64(len(infos)), err
+		}
+
+		if err := tt.policy.Sweep(store, dir); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if got := fmt.Sprint(remaining(t, dir)); got != tt.want {
+			t.Errorf("%s: left %s, want %s", tt.name, got, tt.want)
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/ooni/collector/collector/info"
+	"github.com/ooni/collector/collector/tracing"
+)
+
+// A backup is a stream of JSON lines: a header, one line per report carrying
+// its metadata and the checksum of it, and a trailer with the number of
+// reports and the checksum of all of them.
+const (
+	backupFormat = "ooni-collector-backup"
+	// BackupVersion is the version of the backups written by this collector.
+	// Restore accepts the backups up to this version. Version 1 backups
+	// have no schema version and hold version 0 metadata.
+	BackupVersion = 2
+	// restoreBatchSize is how many reports are written per transaction
+	restoreBatchSize = 1000
+	// maxBackupLine is the longest line accepted in a backup
+	maxBackupLine = 1024 * 1024
+)
+
+// BackupHeader is the first line of a backup
+type BackupHeader struct {
+	Format           string    `json:"format"`
+	Version          int       `json:"version"`
+	CreationTime     time.Time `json:"creation_time"`
+	CollectorVersion string    `json:"collector_version"`
+	// SchemaVersion is the schema version of the metadata of the reports
+	SchemaVersion int `json:"schema_version"`
+	// DataRoot is the data root of the collector that was backed up, used
+	// to relocate the report files on restore
+	DataRoot string `json:"data_root"`
+}
+
+// BackupTrailer is the last line of a backup
+type BackupTrailer struct {
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+type backupLine struct {
+	Header   *BackupHeader   `json:"header,omitempty"`
+	Report   json.RawMessage `json:"report,omitempty"`
+	Checksum string          `json:"checksum,omitempty"`
+	Trailer  *BackupTrailer  `json:"trailer,omitempty"`
+}
+
+// ErrInvalidBackup indicates the backup is corrupted or truncated
+var ErrInvalidBackup = errors.New("Invalid backup")
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Backup writes all the report metadata to w. The reports are read from a
+// single transaction, so the backup is consistent even while the collector
+// is running.
+func (s *Storage) Backup(ctx context.Context, w io.Writer, dataRoot string) (trailer *BackupTrailer, err error) {
+	_, span := tracing.StartSpan(ctx, "storage.Backup")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(backupLine{Header: &BackupHeader{
+		Format:           backupFormat,
+		Version:          BackupVersion,
+		CreationTime:     time.Now().UTC(),
+		CollectorVersion: info.Version,
+		SchemaVersion:    SchemaVersion,
+		DataRoot:         dataRoot,
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	total := sha256.New()
+	trailer = &BackupTrailer{}
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 100
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("report/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			total.Write(val)
+			trailer.Count++
+			err = enc.Encode(backupLine{Report: val, Checksum: checksum(val)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	trailer.Checksum = "sha256:" + hex.EncodeToString(total.Sum(nil))
+	if err = enc.Encode(backupLine{Trailer: trailer}); err != nil {
+		return nil, err
+	}
+	return trailer, bw.Flush()
+}
+
+// BackupFile writes the backup to a temporary file renamed to path once
+// complete, so that a partial backup is never mistaken for a good one
+func (s *Storage) BackupFile(ctx context.Context, path string, dataRoot string) (*BackupTrailer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	trailer, err := s.Backup(ctx, f, dataRoot)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trailer, os.Rename(f.Name(), path)
+}
+
+// readBackup calls fn with the metadata of every report of the backup,
+// checking the header, the checksums and the trailer. fn may be nil.
+func readBackup(r io.Reader, fn func(*BackupHeader, *ReportMetadata) error) (*BackupHeader, *BackupTrailer, error) {
+	var (
+		header  *BackupHeader
+		trailer *BackupTrailer
+		count   int
+		total   = sha256.New()
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBackupLine)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var line backupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, nil, fmt.Errorf("%v: line %d: %v", ErrInvalidBackup, lineNo, err)
+		}
+		switch {
+		case header == nil:
+			if line.Header == nil || line.Header.Format != backupFormat {
+				return nil, nil, fmt.Errorf("%v: missing header", ErrInvalidBackup)
+			}
+			if line.Header.Version > BackupVersion {
+				return nil, nil, fmt.Errorf("backup version %d is newer than the supported version %d",
+					line.Header.Version, BackupVersion)
+			}
+			if line.Header.SchemaVersion > SchemaVersion {
+				return nil, nil, ErrStoreTooNew{Version: line.Header.SchemaVersion}
+			}
+			header = line.Header
+		case trailer != nil:
+			return nil, nil, fmt.Errorf("%v: line %d: data after the trailer", ErrInvalidBackup, lineNo)
+		case line.Trailer != nil:
+			trailer = line.Trailer
+		default:
+			if checksum(line.Report) != line.Checksum {
+				return nil, nil, fmt.Errorf("%v: line %d: checksum mismatch", ErrInvalidBackup, lineNo)
+			}
+			total.Write(line.Report)
+			count++
+			if fn == nil {
+				continue
+			}
+			value, err := migrateReport(line.Report, header.SchemaVersion)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%v: line %d: %v", ErrInvalidBackup, lineNo, err)
+			}
+			var meta ReportMetadata
+			if err := json.Unmarshal(value, &meta); err != nil {
+				return nil, nil, fmt.Errorf("%v: line %d: %v", ErrInvalidBackup, lineNo, err)
+			}
+			if err := fn(header, &meta); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		return nil, nil, fmt.Errorf("%v: missing header", ErrInvalidBackup)
+	}
+	if trailer == nil {
+		return nil, nil, fmt.Errorf("%v: missing trailer, the backup is truncated", ErrInvalidBackup)
+	}
+	if trailer.Count != count || trailer.Checksum != "sha256:"+hex.EncodeToString(total.Sum(nil)) {
+		return nil, nil, fmt.Errorf("%v: the trailer doesn't match the content", ErrInvalidBackup)
+	}
+	return header, trailer, nil
+}
+
+// VerifyBackup checks a backup without restoring it
+func VerifyBackup(r io.Reader) (*BackupHeader, *BackupTrailer, error) {
+	return readBackup(r, nil)
+}
+
+// relocate moves path from the data root oldRoot to newRoot
+func relocate(path string, oldRoot string, newRoot string) string {
+	if oldRoot == "" || newRoot == "" {
+		return path
+	}
+	rel, err := filepath.Rel(oldRoot, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+	return filepath.Join(newRoot, rel)
+}
+
+// Restore writes the report metadata of the backup to the store, replacing
+// the reports with the same ID. The metadata written by older collectors is
+// migrated and the report file paths are moved to dataRoot.
+// The backup should be checked with VerifyBackup first: the reports read
+// before an error is found are already written.
+func (s *Storage) Restore(ctx context.Context, r io.Reader, dataRoot string) (trailer *BackupTrailer, err error) {
+	_, span := tracing.StartSpan(ctx, "storage.Restore")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	var batch []*ReportMetadata
+	flush := func() error {
+		err := s.db.Update(func(txn *badger.Txn) error {
+			for _, meta := range batch {
+				if err := s.writeReport(txn, meta, s.metadataTTL(meta)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		batch = batch[:0]
+		return err
+	}
+	_, trailer, err = readBackup(r, func(header *BackupHeader, meta *ReportMetadata) error {
+		meta.ReportFilePath = relocate(meta.ReportFilePath, header.DataRoot, dataRoot)
+		batch = append(batch, meta)
+		if len(batch) < restoreBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = flush(); err != nil {
+		return nil, err
+	}
+	return trailer, nil
+}
@@ -0,0 +1,383 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/dgraph-io/badger"
+	"github.com/ooni/collector/collector/metrics"
+)
+
+// expiryCheckInterval is how often the store looks for metadata about to
+// expire
+const expiryCheckInterval = 10 * time.Minute
+
+// Tombstone is the compact record of a report kept for store.tombstone-ttl
+// once its metadata expired, so that the report is still known, ex. to not
+// upload it twice
+type Tombstone struct {
+	ReportID       string    `json:"report_id"`
+	TestName       string    `json:"test_name"`
+	ProbeCC        string    `json:"probe_cc"`
+	ProbeASN       string    `json:"probe_asn"`
+	CreationTime   time.Time `json:"creation_time"`
+	LastUpdateTime time.Time `json:"last_update_time"`
+	EntryCount     int64     `json:"entry_count"`
+	Closed         bool      `json:"closed"`
+	Uploaded       bool      `json:"uploaded"`
+}
+
+func tombstoneKey(reportID string) []byte {
+	return []byte(fmt.Sprintf("tombstone/%s", reportID))
+}
+
+// metadataTTL returns how long the metadata of the report is kept after this
+// update
+func (s *Storage) metadataTTL(m *ReportMetadata) time.Duration {
+	if m.Closed {
+		return s.config().ClosedMetadataTTL
+	}
+	return s.config().OpenMetadataTTL
+}
+
+func newTombstone(m *ReportMetadata) *Tombstone {
+	return &Tombstone{
+		ReportID:       m.ReportID,
+		TestName:       m.TestName,
+		ProbeCC:        m.ProbeCC,
+		ProbeASN:       m.ProbeASN,
+		CreationTime:   m.CreationTime,
+		LastUpdateTime: m.LastUpdateTime,
+		EntryCount:     m.EntryCount,
+		Closed:         m.Closed,
+		Uploaded:       m.Uploaded,
+	}
+}
+
+// writeTombstone writes the compact record of the report within txn. It
+// expires store.tombstone-ttl after the metadata.
+func (s *Storage) writeTombstone(txn *badger.Txn, m *ReportMetadata, ttl time.Duration) error {
+	tombstoneTTL := s.config().TombstoneTTL
+	if tombstoneTTL == 0 {
+		return nil
+	}
+	value, err := json.Marshal(newTombstone(m))
+	if err != nil {
+		return err
+	}
+	return txn.SetWithTTL(tombstoneKey(m.ReportID), value, ttl+tombstoneTTL)
+}
+
+// MarkUploaded records in its tombstone that a report whose metadata has
+// expired was uploaded, ex. by the backfill. The metadata is not written
+// back. Without a tombstone, one is created from m for store.tombstone-ttl.
+func (s *Storage) MarkUploaded(ctx context.Context, m *ReportMetadata) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+	tombstoneTTL := s.config().TombstoneTTL
+	if tombstoneTTL == 0 {
+		return nil
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		if _, err := getReport(txn, m.ReportID); err != ErrReportNotFound {
+			if err == nil {
+				return fmt.Errorf("the metadata of report %s has not expired", m.ReportID)
+			}
+			return err
+		}
+		t := newTombstone(m)
+		ttl := tombstoneTTL
+		item, err := txn.Get(tombstoneKey(m.ReportID))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err == nil {
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if err = json.Unmarshal(val, t); err != nil {
+				return err
+			}
+			if item.ExpiresAt() != 0 {
+				ttl = time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+			}
+		}
+		t.Uploaded = true
+		value, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return txn.SetWithTTL(tombstoneKey(m.ReportID), value, ttl)
+	})
+}
+
+// GetTombstone returns the compact record of a report, which outlives its
+// metadata
+func (s *Storage) GetTombstone(ctx context.Context, reportID string) (*Tombstone, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+	var t Tombstone
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(tombstoneKey(reportID))
+		if err == badger.ErrKeyNotFound {
+			return ErrReportNotFound
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(val, &t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ExpiryHook is called with the metadata of a report expiring at expiresAt
+type ExpiryHook func(ctx context.Context, m *ReportMetadata, expiresAt time.Time)
+
+// expiryHooks are the hooks registered with OnExpiry and the reports they
+// have been called for, by expiry time
+type expiryHooks struct {
+	sync.Mutex
+	hooks    []ExpiryHook
+	notified map[string]time.Time
+	// watching is set while the expiry of the metadata is watched
+	watching bool
+}
+
+// OnExpiry registers a function called once for every report whose metadata
+// expires within store.expiry-notice. A hook updating the report postpones
+// the expiry and is called again when the new expiry comes close. The first
+// hook starts watching the expiry of the metadata, while the store is open.
+func (s *Storage) OnExpiry(hook ExpiryHook) {
+	s.expiry.Lock()
+	s.expiry.hooks = append(s.expiry.hooks, hook)
+	s.expiry.Unlock()
+	s.startExpiryNotices()
+}
+
+// startExpiryNotices watches the expiry of the metadata in the background
+// if the store is open and a hook is registered
+func (s *Storage) startExpiryNotices() {
+	if err := s.open(); err != nil {
+		return
+	}
+	defer s.mu.RUnlock()
+	s.expiry.Lock()
+	defer s.expiry.Unlock()
+	if len(s.expiry.hooks) == 0 || s.expiry.watching {
+		return
+	}
+	s.expiry.watching = true
+	s.startWorker(s.ctx, s.runExpiryNotices)
+}
+
+// lostExpiry returns the keys starting with prefix that have no expiry
+func lostExpiry(txn *badger.Txn, prefix []byte) [][]byte {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if it.Item().ExpiresAt() == 0 {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+	}
+	return keys
+}
+
+// restoreKeyExpiry sets the expiry of the report or tombstone at key from
+// its last update, unless it has one. It reads the key again within txn, so
+// that a concurrent update makes the transaction conflict.
+func (s *Storage) restoreKeyExpiry(txn *badger.Txn, key []byte) error {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if item.ExpiresAt() != 0 {
+		return nil
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	// A tombstone has the fields needed from the metadata
+	var meta ReportMetadata
+	if err = json.Unmarshal(val, &meta); err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	ttl := time.Until(meta.LastUpdateTime.Add(s.metadataTTL(&meta)))
+	if bytes.HasPrefix(key, []byte("report/")) {
+		// Leave the hooks a chance to see it before it expires
+		if ttl < expiryCheckInterval {
+			ttl = expiryCheckInterval
+		}
+		return s.writeReport(txn, &meta, ttl)
+	}
+	ttl += s.config().TombstoneTTL
+	if ttl <= 0 {
+		return txn.Delete(key)
+	}
+	return txn.SetWithTTL(key, val, ttl)
+}
+
+// restoreExpiry sets the expiry of the reports and tombstones that have
+// none. badger drops the expiry of the entries it replays from the value log
+// when the store was not closed cleanly, which would keep them forever.
+func (s *Storage) restoreExpiry() (int, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		keys = append(lostExpiry(txn, []byte("report/")), lostExpiry(txn, []byte("tombstone/"))...)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(keys); i += migrationBatchSize {
+		batch := keys[i:]
+		if len(batch) > migrationBatchSize {
+			batch = batch[:migrationBatchSize]
+		}
+		err = s.db.Update(func(txn *badger.Txn) error {
+			for _, key := range batch {
+				if err := s.restoreKeyExpiry(txn, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+type expiring struct {
+	meta      *ReportMetadata
+	expiresAt time.Time
+}
+
+// findExpiring returns the reports whose metadata expires before deadline
+func (s *Storage) findExpiring(deadline time.Time) ([]expiring, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+	var found []expiring
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("report/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if item.ExpiresAt() == 0 {
+				continue
+			}
+			expiresAt := time.Unix(int64(item.ExpiresAt()), 0)
+			if expiresAt.After(deadline) {
+				continue
+			}
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var meta ReportMetadata
+			if err = json.Unmarshal(val, &meta); err != nil {
+				return fmt.Errorf("%s: %v", item.Key(), err)
+			}
+			found = append(found, expiring{meta: &meta, expiresAt: expiresAt})
+		}
+		return nil
+	})
+	return found, err
+}
+
+// notifyExpiring calls the expiry hooks for the reports they have not been
+// called for yet
+func (s *Storage) notifyExpiring(ctx context.Context) error {
+	s.expiry.Lock()
+	hooks := s.expiry.hooks
+	s.expiry.Unlock()
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	found, err := s.findExpiring(now.Add(s.config().ExpiryNotice))
+	if err != nil {
+		return err
+	}
+	s.expiry.Lock()
+	for reportID, expiresAt := range s.expiry.notified {
+		if expiresAt.Before(now) {
+			delete(s.expiry.notified, reportID)
+		}
+	}
+	var pending []expiring
+	for _, e := range found {
+		if s.expiry.notified[e.meta.ReportID].Equal(e.expiresAt) {
+			continue
+		}
+		s.expiry.notified[e.meta.ReportID] = e.expiresAt
+		pending = append(pending, e)
+	}
+	s.expiry.Unlock()
+
+	for _, e := range pending {
+		log.Debugf("metadata of report %s expires at %s", e.meta.ReportID, e.expiresAt)
+		metrics.MetadataExpiring.WithLabelValues(e.meta.State()).Inc()
+		for _, hook := range hooks {
+			hook(ctx, e.meta, e.expiresAt)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) runExpiryNotices(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+	for {
+		count, err := s.restoreExpiry()
+		if err != nil {
+			// A conflicting update is retried at the next check
+			log.WithError(err).Error("failed to restore the expiry of the metadata")
+		} else if count > 0 {
+			log.Infof("restored the expiry of %d reports and tombstones", count)
+		}
+		if err = s.notifyExpiring(ctx); err != nil {
+			log.WithError(err).Error("failed to look for expiring metadata")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The secondary indexes are keys without value pointing at the report ID,
+// ex. index/state/open/<report-id>. They are written in the same transaction
+// as the metadata and expire with it.
+const (
+	indexPrefix   = "index/"
+	indexState    = "state"
+	indexUpdated  = "updated"
+	indexTestName = "test"
+	indexProbeCC  = "cc"
+	// updateBucketFormat is the granularity of the last update index. It
+	// sorts like the time it stands for.
+	updateBucketFormat = "2006010215"
+)
+
+func reportKey(reportID string) []byte {
+	return []byte(fmt.Sprintf("report/%s", reportID))
+}
+
+func indexKey(index string, value string, reportID string) []byte {
+	return []byte(fmt.Sprintf("%s%s/%s/%s", indexPrefix, index, value, reportID))
+}
+
+func updateBucket(t time.Time) string {
+	return t.UTC().Format(updateBucketFormat)
+}
+
+// indexKeys returns the index keys of the report
+func indexKeys(m *ReportMetadata) [][]byte {
+	keys := [][]byte{
+		indexKey(indexState, m.State(), m.ReportID),
+		indexKey(indexUpdated, updateBucket(m.LastUpdateTime), m.ReportID),
+		indexKey(indexTestName, m.TestName, m.ReportID),
+	}
+	if m.ProbeCC != "" {
+		keys = append(keys, indexKey(indexProbeCC, m.ProbeCC, m.ReportID))
+	}
+	return keys
+}
+
+// getReport reads the metadata of a report within txn
+func getReport(txn *badger.Txn, reportID string) (*ReportMetadata, error) {
+	item, err := txn.Get(reportKey(reportID))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrReportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	var meta ReportMetadata
+	if err = json.Unmarshal(val, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// dropIndexKeys deletes the keys of old that are not in keys
+func dropIndexKeys(txn *badger.Txn, old *ReportMetadata, keys [][]byte) error {
+	for _, oldKey := range indexKeys(old) {
+		stale := true
+		for _, key := range keys {
+			if bytes.Equal(oldKey, key) {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+		if err := txn.Delete(oldKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReport writes the metadata of the report, its index keys and its
+// tombstone within txn, removing the index keys of the previous version of
+// the metadata
+func (s *Storage) writeReport(txn *badger.Txn, m *ReportMetadata, ttl time.Duration) error {
+	keys := indexKeys(m)
+	old, err := getReport(txn, m.ReportID)
+	if err == nil {
+		err = dropIndexKeys(txn, old, keys)
+	} else if err == ErrReportNotFound {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = txn.SetWithTTL(reportKey(m.ReportID), value, ttl); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = txn.SetWithTTL(key, []byte{}, ttl); err != nil {
+			return err
+		}
+	}
+	return s.writeTombstone(txn, m, ttl)
+}
+
+// deleteReport deletes the metadata of the report and its index keys. The
+// tombstone is kept until it expires.
+func deleteReport(txn *badger.Txn, reportID string) error {
+	old, err := getReport(txn, reportID)
+	if err == ErrReportNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = dropIndexKeys(txn, old, nil); err != nil {
+		return err
+	}
+	return txn.Delete(reportKey(reportID))
+}
+
+// indexedIDs returns the report IDs of the index keys starting with prefix.
+// When until is set the scan stops at the first key sorting after it.
+func indexedIDs(txn *badger.Txn, prefix []byte, until []byte) []string {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var ids []string
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		if until != nil && bytes.Compare(key, until) > 0 {
+			break
+		}
+		ids = append(ids, string(key[bytes.LastIndexByte(key, '/')+1:]))
+	}
+	return ids
+}
+
+// findIndexed returns the reports selected by the filter using the most
+// selective index it can, or nil, false when no index applies
+func findIndexed(txn *badger.Txn, f Filter) ([]*ReportMetadata, bool, error) {
+	var (
+		prefix []byte
+		until  []byte
+	)
+	// Roughly from the most to the least selective index
+	switch {
+	case f.TestName != "":
+		prefix = []byte(fmt.Sprintf("%s%s/%s/", indexPrefix, indexTestName, f.TestName))
+	case f.ProbeCC != "":
+		prefix = []byte(fmt.Sprintf("%s%s/%s/", indexPrefix, indexProbeCC, f.ProbeCC))
+	case !f.UpdatedBefore.IsZero():
+		prefix = []byte(fmt.Sprintf("%s%s/", indexPrefix, indexUpdated))
+		// The last key of the bucket holding the cutoff
+		until = []byte(fmt.Sprintf("%s%s/%s/\xff", indexPrefix, indexUpdated, updateBucket(f.UpdatedBefore)))
+	case f.State != "":
+		prefix = []byte(fmt.Sprintf("%s%s/%s/", indexPrefix, indexState, f.State))
+	default:
+		return nil, false, nil
+	}
+
+	var found []*ReportMetadata
+	for _, reportID := range indexedIDs(txn, prefix, until) {
+		meta, err := getReport(txn, reportID)
+		if err == ErrReportNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, true, err
+		}
+		if f.Match(meta) {
+			found = append(found, meta)
+		}
+	}
+	return found, true, nil
+}
+
+// buildIndexes writes the index keys of every report, with the expiry of
+// the report
+func (s *Storage) buildIndexes() (int, error) {
+	var count int
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 100
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("report/")
+
+		wb := s.db.NewTransaction(true)
+		defer func() { wb.Discard() }()
+		pending := 0
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			var meta ReportMetadata
+			if err = json.Unmarshal(val, &meta); err != nil {
+				return fmt.Errorf("%s: %v", item.Key(), err)
+			}
+			ttl := s.metadataTTL(&meta)
+			if item.ExpiresAt() != 0 {
+				ttl = time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+			}
+			if ttl <= 0 {
+				continue
+			}
+			for _, key := range indexKeys(&meta) {
+				if err = wb.SetWithTTL(key, []byte{}, ttl); err != nil {
+					return err
+				}
+			}
+			count++
+			if pending++; pending < migrationBatchSize {
+				continue
+			}
+			if err = wb.Commit(nil); err != nil {
+				return err
+			}
+			wb = s.db.NewTransaction(true)
+			pending = 0
+		}
+		return wb.Commit(nil)
+	})
+	return count, err
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportIDs returns the sorted IDs of the reports
+func reportIDs(reports []*ReportMetadata) string {
+	var ids []string
+	for _, m := range reports {
+		ids = append(ids, m.ReportID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestWriteReportDropsIndexKeys(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	m := testReport("r1")
+	if err := s.SetReport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"index/cc/IT/r1",
+		"index/state/open/r1",
+		"index/test/web_connectivity/r1",
+		"index/updated/" + updateBucket(m.LastUpdateTime) + "/r1",
+	}
+	if found := keys(t, s, "index/"); strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Errorf("index keys = %v, want %v", found, want)
+	}
+
+	// The state, the test name and the last update change
+	m.Closed = true
+	m.TestName = "ndt"
+	m.LastUpdateTime = m.LastUpdateTime.Add(2 * time.Hour)
+	if err := s.SetReport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"index/cc/IT/r1",
+		"index/state/closed/r1",
+		"index/test/ndt/r1",
+		"index/updated/" + updateBucket(m.LastUpdateTime) + "/r1",
+	}
+	if found := keys(t, s, "index/"); strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Errorf("index keys = %v, want %v", found, want)
+	}
+
+	// Without a country the key is dropped
+	m.ProbeCC = ""
+	if err := s.SetReport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if found := keys(t, s, "index/cc/"); len(found) > 0 {
+		t.Errorf("index keys of the country = %v", found)
+	}
+
+	if err := s.DeleteReport(ctx, m.ReportID); err != nil {
+		t.Fatal(err)
+	}
+	if found := keys(t, s, "index/"); len(found) > 0 {
+		t.Errorf("index keys of a deleted report = %v", found)
+	}
+}
+
+func TestFindUpdatedBefore(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	cutoff := time.Now().UTC().Add(-3 * time.Hour).Truncate(time.Hour).Add(30 * time.Minute)
+	updates := map[string]time.Time{
+		"hour-before": cutoff.Add(-time.Hour),
+		// In the bucket of the cutoff, on either side of it
+		"same-hour-before": cutoff.Add(-time.Minute),
+		"same-hour-after":  cutoff.Add(time.Minute),
+		"hour-after":       cutoff.Add(time.Hour),
+	}
+	for id, updated := range updates {
+		m := testReport(id)
+		m.LastUpdateTime = updated
+		if err := s.SetReport(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := s.FindReports(ctx, Filter{UpdatedBefore: cutoff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reportIDs(found); ids != "hour-before,same-hour-before" {
+		t.Errorf("reports updated before the cutoff = %s", ids)
+	}
+	// On the hour the previous bucket is the last one read
+	found, err = s.FindReports(ctx, Filter{UpdatedBefore: cutoff.Truncate(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reportIDs(found); ids != "hour-before" {
+		t.Errorf("reports updated before the hour = %s", ids)
+	}
+}
+
+func TestFindReportsMatchesScan(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	reports := []struct {
+		id       string
+		testName string
+		cc       string
+		asn      string
+		closed   bool
+		age      time.Duration
+	}{
+		{"r1", "web_connectivity", "IT", "AS1", false, 0},
+		{"r2", "web_connectivity", "IT", "AS2", true, time.Hour},
+		{"r3", "web_connectivity", "DE", "AS1", true, 3 * time.Hour},
+		{"r4", "ndt", "IT", "AS1", false, 5 * time.Hour},
+		{"r5", "ndt", "", "AS3", true, 30 * time.Minute},
+		{"r6", "dash", "US", "AS2", false, 26 * time.Hour},
+	}
+	for _, r := range reports {
+		m := testReport(r.id)
+		m.TestName, m.ProbeCC, m.ProbeASN, m.Closed = r.testName, r.cc, r.asn, r.closed
+		m.LastUpdateTime = now.Add(-r.age)
+		if err := s.SetReport(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filters := []Filter{
+		{},
+		{State: StateOpen},
+		{State: StateClosed},
+		{TestName: "web_connectivity"},
+		{TestName: "ndt", State: StateClosed},
+		{TestName: "missing"},
+		{ProbeCC: "IT"},
+		{ProbeCC: "IT", State: StateOpen},
+		{ProbeASN: "AS1"},
+		{ProbeASN: "AS2", State: StateClosed},
+		{UpdatedBefore: now.Add(-2 * time.Hour)},
+		{UpdatedBefore: now.Add(-45 * time.Minute), State: StateClosed},
+		{UpdatedBefore: now.Add(-time.Hour), ProbeCC: "IT"},
+		{UpdatedBefore: now.Add(time.Hour)},
+	}
+	all, err := s.ListReports(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range filters {
+		var want []*ReportMetadata
+		for _, m := range all {
+			if f.Match(m) {
+				want = append(want, m)
+			}
+		}
+		found, err := s.FindReports(ctx, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reportIDs(found) != reportIDs(want) {
+			t.Errorf("FindReports(%+v) = %s, want %s", f, reportIDs(found), reportIDs(want))
+		}
+	}
+}
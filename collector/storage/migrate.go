@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/dgraph-io/badger"
+	"github.com/ooni/collector/collector/tracing"
+)
+
+// SchemaVersion is the version of the layout of the store written by this
+// collector. Stores without a version key were written before versioning was
+// introduced and are at version 0.
+const SchemaVersion = 2
+
+// schemaVersionKey holds the schema version of the store
+var schemaVersionKey = []byte("meta/schema-version")
+
+// migrationBatchSize is how many reports are rewritten per transaction
+const migrationBatchSize = 1000
+
+// migration upgrades the store from version-1 to version
+type migration struct {
+	version     int
+	description string
+	// report rewrites the metadata of a report, it's also applied to the
+	// reports restored from older backups. It must accept metadata already
+	// in the new layout, so that an interrupted migration can run again.
+	report func(value []byte) ([]byte, error)
+	// apply changes the layout of the store, it defaults to rewriting every
+	// report with report. It must be safe to run it again.
+	apply func(s *Storage) (int, error)
+}
+
+// migrations are the upgrade steps, in order. A change of the layout of the
+// store comes with a new step and a bump of SchemaVersion.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "name the report metadata fields in snake_case",
+		report:      snakeCaseReport,
+	},
+	{
+		version:     2,
+		description: "index the reports by state, last update, test_name and probe_cc",
+		apply:       (*Storage).buildIndexes,
+	},
+}
+
+// snakeCaseFields maps the untagged field names of the version 0 metadata to
+// the JSON names of ReportMetadata
+var snakeCaseFields = map[string]string{
+	"ReportID":        "report_id",
+	"ProbeASN":        "probe_asn",
+	"ProbeCC":         "probe_cc",
+	"Platform":        "platform",
+	"TestName":        "test_name",
+	"SoftwareName":    "software_name",
+	"SoftwareVersion": "software_version",
+	"ReportFilePath":  "report_file_path",
+	"CreationTime":    "creation_time",
+	"LastUpdateTime":  "last_update_time",
+	"EntryCount":      "entry_count",
+	"Closed":          "closed",
+	"Uploaded":        "uploaded",
+	"UploadTime":      "upload_time",
+	"UploadAttempts":  "upload_attempts",
+	"UploadError":     "upload_error",
+}
+
+func snakeCaseReport(value []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for name, v := range fields {
+		if snake, ok := snakeCaseFields[name]; ok {
+			name = snake
+		}
+		renamed[name] = v
+	}
+	return json.Marshal(renamed)
+}
+
+// ErrStoreTooNew indicates the store was written by a newer collector
+type ErrStoreTooNew struct {
+	Version int
+}
+
+func (e ErrStoreTooNew) Error() string {
+	return fmt.Sprintf("store schema version %d is newer than the supported version %d, upgrade the collector",
+		e.Version, SchemaVersion)
+}
+
+// migrateReport upgrades the metadata of a report written at version from
+func migrateReport(value []byte, from int) ([]byte, error) {
+	var err error
+	for _, m := range migrations {
+		if m.version <= from || m.report == nil {
+			continue
+		}
+		if value, err = m.report(value); err != nil {
+			return nil, fmt.Errorf("migration to version %d: %v", m.version, err)
+		}
+	}
+	return value, nil
+}
+
+// SchemaVersion returns the schema version of the store
+func (s *Storage) SchemaVersion() (int, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	defer s.mu.RUnlock()
+	return s.schemaVersion()
+}
+
+func (s *Storage) schemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(schemaVersionKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		val, err := item.Value()
+		if err != nil {
+			return err
+		}
+		version, err = strconv.Atoi(string(val))
+		return err
+	})
+	return version, err
+}
+
+func (s *Storage) setSchemaVersion(version int) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(schemaVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
+
+// isEmpty tells whether the store holds no report
+func (s *Storage) isEmpty() (bool, error) {
+	empty := true
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("report/")
+		it.Seek(prefix)
+		empty = !it.ValidForPrefix(prefix)
+		return nil
+	})
+	return empty, err
+}
+
+type rewrite struct {
+	key       []byte
+	value     []byte
+	expiresAt uint64
+	// ttl is the expiry of the reports that had none
+	ttl time.Duration
+}
+
+// rewriteReports applies fn to the metadata of every report, keeping their
+// expiry, and returns the number of reports written. The reports without an
+// expiry get the one of their state, the reports expiring meanwhile are
+// skipped.
+func (s *Storage) rewriteReports(fn func([]byte) ([]byte, error)) (int, error) {
+	var (
+		batch []rewrite
+		count int
+	)
+	flush := func() error {
+		written := 0
+		err := s.db.Update(func(txn *badger.Txn) error {
+			written = 0
+			for _, r := range batch {
+				ttl := r.ttl
+				if r.expiresAt != 0 {
+					ttl = time.Until(time.Unix(int64(r.expiresAt), 0))
+				}
+				if ttl <= 0 {
+					continue
+				}
+				if err := txn.SetWithTTL(r.key, r.value, ttl); err != nil {
+					return err
+				}
+				written++
+			}
+			return nil
+		})
+		if err == nil {
+			count += written
+		}
+		batch = batch[:0]
+		return err
+	}
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 100
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("report/")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if val, err = fn(val); err != nil {
+				return fmt.Errorf("%s: %v", item.Key(), err)
+			}
+			r := rewrite{
+				key:       item.KeyCopy(nil),
+				value:     val,
+				expiresAt: item.ExpiresAt(),
+			}
+			if r.expiresAt == 0 {
+				var meta ReportMetadata
+				if err = json.Unmarshal(val, &meta); err != nil {
+					return fmt.Errorf("%s: %v", item.Key(), err)
+				}
+				r.ttl = s.metadataTTL(&meta)
+			}
+			batch = append(batch, r)
+			if len(batch) < migrationBatchSize {
+				continue
+			}
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, flush()
+}
+
+// Migrate upgrades the store to SchemaVersion. It refuses stores written by
+// a newer collector. A new store is created at SchemaVersion.
+func (s *Storage) Migrate(ctx context.Context) (err error) {
+	_, span := tracing.StartSpan(ctx, "storage.Migrate")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return ErrStoreTooNew{Version: version}
+	}
+	if version == 0 {
+		empty, err := s.isEmpty()
+		if err != nil {
+			return err
+		}
+		if empty {
+			return s.setSchemaVersion(SchemaVersion)
+		}
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		log.Infof("migrating the store to version %d: %s", m.version, m.description)
+		start := time.Now()
+		var count int
+		if m.apply != nil {
+			count, err = m.apply(s)
+		} else {
+			count, err = s.rewriteReports(m.report)
+		}
+		if err != nil {
+			return fmt.Errorf("migration to version %d failed: %v", m.version, err)
+		}
+		if err = s.setSchemaVersion(m.version); err != nil {
+			return err
+		}
+		log.Infof("migrated %d reports to version %d in %s", count, m.version, time.Since(start))
+	}
+	return nil
+}
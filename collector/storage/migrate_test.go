@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// version0Report is the metadata of a report as written before the schema
+// was versioned, with the untagged field names
+func version0Report(id string, closed bool) string {
+	return fmt.Sprintf(`{"ReportID":%q,"ProbeASN":"AS1","ProbeCC":"IT","Platform":"linux",`+
+		`"TestName":"web_connectivity","SoftwareName":"ooniprobe","SoftwareVersion":"2.0.0",`+
+		`"ReportFilePath":"/var/ooni-collector/reports/%s.json",`+
+		`"CreationTime":"2018-06-01T10:00:00Z","LastUpdateTime":%q,`+
+		`"EntryCount":3,"Closed":%t}`,
+		id, id, time.Now().UTC().Format(time.RFC3339), closed)
+}
+
+// checkMigrated checks the store is at SchemaVersion with the reports in the
+// current layout, indexed and expiring
+func checkMigrated(t *testing.T, s *Storage, open []string, closed []string) {
+	ctx := context.Background()
+	version, err := s.SchemaVersion()
+	if err != nil || version != SchemaVersion {
+		t.Errorf("schema version = %d, %v, want %d", version, err, SchemaVersion)
+	}
+	for _, id := range append(append([]string{}, open...), closed...) {
+		m, err := s.GetReport(ctx, id)
+		if err != nil {
+			t.Errorf("GetReport(%s): %v", id, err)
+			continue
+		}
+		if m.ReportID != id || m.ProbeCC != "IT" || m.TestName != "web_connectivity" ||
+			m.EntryCount != 3 || m.ReportFilePath != "/var/ooni-collector/reports/"+id+".json" {
+			t.Errorf("report %s not migrated: %+v", id, m)
+		}
+	}
+	for state, want := range map[string][]string{StateOpen: open, StateClosed: closed} {
+		found, err := s.FindReports(ctx, Filter{State: state})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, m := range found {
+			ids = append(ids, m.ReportID)
+		}
+		if strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Errorf("%s reports = %v, want %v", state, ids, want)
+		}
+	}
+	err = s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().Key()
+			if bytes.Equal(key, schemaVersionKey) {
+				continue
+			}
+			if it.Item().ExpiresAt() == 0 {
+				t.Errorf("%s lost its expiry", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateVersion0(t *testing.T) {
+	dir := testDir(t)
+	writeRaw(t, dir, map[string]string{
+		"report/r1": version0Report("r1", false),
+		"report/r2": version0Report("r2", true),
+	})
+	s, cleanup := openTestStore(t, dir)
+	defer cleanup()
+	checkMigrated(t, s, []string{"r1"}, []string{"r2"})
+}
+
+func TestMigrateInterrupted(t *testing.T) {
+	snakeCase, err := snakeCaseReport([]byte(version0Report("r1", false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		kv   map[string]string
+	}{
+		{
+			// Stopped while renaming the fields, r1 is in the new layout
+			name: "version 1",
+			kv: map[string]string{
+				"report/r1": string(snakeCase),
+				"report/r2": version0Report("r2", true),
+			},
+		},
+		{
+			// Stopped while indexing, r1 is indexed
+			name: "version 2",
+			kv: map[string]string{
+				string(schemaVersionKey):         "1",
+				"report/r1":                      string(snakeCase),
+				"report/r2":                      string(mustSnakeCase(t, version0Report("r2", true))),
+				"index/state/open/r1":            "",
+				"index/test/web_connectivity/r1": "",
+				"index/cc/IT/r1":                 "",
+				"index/updated/" + updateBucket(time.Now()) + "/r1": "",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testDir(t)
+			writeRaw(t, dir, tt.kv)
+			s, cleanup := openTestStore(t, dir)
+			defer cleanup()
+			checkMigrated(t, s, []string{"r1"}, []string{"r2"})
+
+			// Running it again changes nothing
+			if err := s.setSchemaVersion(0); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			checkMigrated(t, s, []string{"r1"}, []string{"r2"})
+		})
+	}
+}
+
+func mustSnakeCase(t *testing.T, report string) []byte {
+	value, err := snakeCaseReport([]byte(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestMigrateCount(t *testing.T) {
+	dir := testDir(t)
+	kv := make(map[string]string)
+	for i := 0; i < migrationBatchSize+10; i++ {
+		id := fmt.Sprintf("r%d", i)
+		kv["report/"+id] = version0Report(id, false)
+	}
+	writeRaw(t, dir, kv)
+	s, cleanup := openTestStore(t, dir)
+	defer cleanup()
+
+	count, err := s.rewriteReports(snakeCaseReport)
+	if err != nil || count != len(kv) {
+		t.Errorf("rewrote %d reports, %v, want %d", count, err, len(kv))
+	}
+}
+
+func TestMigrateExpiry(t *testing.T) {
+	dir := testDir(t)
+	// Written by a collector that didn't expire the metadata
+	writeRawWithTTL(t, dir, map[string]string{
+		"report/r1": version0Report("r1", false),
+		"report/r2": version0Report("r2", true),
+	}, 0)
+	s, cleanup := openTestStore(t, dir)
+	defer cleanup()
+
+	cfg := testConfig(t)
+	for key, ttl := range map[string]time.Duration{
+		"report/r1": cfg.OpenMetadataTTL,
+		"report/r2": cfg.ClosedMetadataTTL,
+	} {
+		err := s.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			expiry := time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+			if expiry > ttl || expiry < ttl-time.Minute {
+				t.Errorf("%s expires in %s, want %s", key, expiry, ttl)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerStore(t *testing.T) {
+	dir := testDir(t)
+	writeRaw(t, dir, map[string]string{
+		string(schemaVersionKey): fmt.Sprint(SchemaVersion + 1),
+		"report/r1":              version0Report("r1", false),
+	})
+	s := New(dir, testConfig(t))
+	err := s.Init()
+	if e, ok := err.(ErrStoreTooNew); !ok || e.Version != SchemaVersion+1 {
+		s.Close()
+		t.Fatalf("Init() = %v, want ErrStoreTooNew", err)
+	}
+	defer os.RemoveAll(dir)
+	// The store is closed, its database can be opened again
+	if _, err = s.GetReport(context.Background(), "r1"); err != ErrStoreNotOpen {
+		t.Errorf("GetReport on a refused store: %v", err)
+	}
+	writeRaw(t, dir, nil)
+}
+
+// backupOf writes a backup of the given version holding the reports
+func backupOf(t *testing.T, header BackupHeader, reports ...string) string {
+	var (
+		buf   bytes.Buffer
+		total []byte
+	)
+	enc := json.NewEncoder(&buf)
+	enc.Encode(backupLine{Header: &header})
+	for _, r := range reports {
+		enc.Encode(backupLine{Report: json.RawMessage(r), Checksum: checksum([]byte(r))})
+		total = append(total, r...)
+	}
+	enc.Encode(backupLine{Trailer: &BackupTrailer{Count: len(reports), Checksum: checksum(total)}})
+	return buf.String()
+}
+
+func TestRestoreVersion1Backup(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// Version 1 backups have no schema version and hold version 0 metadata
+	backup := backupOf(t, BackupHeader{
+		Format:   backupFormat,
+		Version:  1,
+		DataRoot: "/var/ooni-collector",
+	}, version0Report("r1", true))
+	if _, err := s.Restore(context.Background(), strings.NewReader(backup), "/srv/collector"); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.GetReport(context.Background(), "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ProbeCC != "IT" || m.EntryCount != 3 || m.Closed != true ||
+		m.ReportFilePath != "/srv/collector/reports/r1.json" {
+		t.Errorf("restored report = %+v", m)
+	}
+	found, err := s.FindReports(context.Background(), Filter{State: StateClosed, TestName: "web_connectivity"})
+	if err != nil || len(found) != 1 {
+		t.Errorf("restored report not indexed: %v, %v", found, err)
+	}
+
+	// A backup of a newer schema is refused
+	backup = backupOf(t, BackupHeader{
+		Format:        backupFormat,
+		Version:       BackupVersion,
+		SchemaVersion: SchemaVersion + 1,
+	}, version0Report("r2", true))
+	if _, err = s.Restore(context.Background(), strings.NewReader(backup), ""); err == nil {
+		t.Error("restored a backup of a newer schema")
+	}
+}
@@ -4,77 +4,234 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/apex/log"
 	"github.com/dgraph-io/badger"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/metrics"
+	"github.com/ooni/collector/collector/tracing"
 )
 
-// ReportMetadata contains metadata about the report
+// ReportMetadata contains metadata about the report. Changing the name of a
+// field changes the layout of the store and needs a migration.
 type ReportMetadata struct {
-	ReportID        string
-	ProbeASN        string
-	ProbeCC         string
-	Platform        string
-	TestName        string
-	SoftwareName    string
-	SoftwareVersion string
-	ReportFilePath  string
-	CreationTime    time.Time
-	LastUpdateTime  time.Time
-	EntryCount      int64
-	Closed          bool
-}
-
-// By default we will expire the report metadata after 30 days
+	ReportID        string    `json:"report_id"`
+	ProbeASN        string    `json:"probe_asn"`
+	ProbeCC         string    `json:"probe_cc"`
+	Platform        string    `json:"platform"`
+	TestName        string    `json:"test_name"`
+	SoftwareName    string    `json:"software_name"`
+	SoftwareVersion string    `json:"software_version"`
+	ReportFilePath  string    `json:"report_file_path"`
+	CreationTime    time.Time `json:"creation_time"`
+	LastUpdateTime  time.Time `json:"last_update_time"`
+	EntryCount      int64     `json:"entry_count"`
+	Closed          bool      `json:"closed"`
+	// Uploaded is set once the closed report reached all the sinks
+	Uploaded   bool      `json:"uploaded"`
+	UploadTime time.Time `json:"upload_time"`
+	// UploadAttempts and UploadError record the failed uploads
+	UploadAttempts int    `json:"upload_attempts"`
+	UploadError    string `json:"upload_error"`
+}
+
+// The report metadata expires after store.open-metadata-ttl or
+// store.closed-metadata-ttl, see metadataTTL
 const (
-	reportExpiryDuration      = 24 * 30 * time.Hour
 	garbageCollectionInterval = 1 * time.Hour
 	discardRatio              = 0.5
 )
 
-// New func implements the storage interface for gorush (https://github.com/appleboy/gorush)
-func New(dir string) *Storage {
+// New func implements the storage interface for gorush (https://github.com/appleboy/gorush).
+// cfg sets the expiry of the metadata, SetConfig changes it.
+func New(dir string, cfg config.Store) *Storage {
 	opts := badger.DefaultOptions
 	opts.Dir = dir
 	opts.ValueDir = dir
-	return &Storage{
-		db:   nil,
-		opts: opts,
+	s := &Storage{
+		db:     nil,
+		opts:   opts,
+		expiry: expiryHooks{notified: make(map[string]time.Time)},
 	}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig changes the expiry of the metadata written from now on, ex. on
+// reload
+func (s *Storage) SetConfig(cfg config.Store) {
+	s.cfg.Store(cfg)
+}
+
+func (s *Storage) config() config.Store {
+	return s.cfg.Load().(config.Store)
 }
 
 // Storage interface implementation for badger
 type Storage struct {
-	opts       badger.Options
+	opts badger.Options
+	// mu guards db, which is nil while the store is not open. The methods
+	// hold it for reading while they use db, Init and Close for writing.
+	mu         sync.RWMutex
 	db         *badger.DB
 	ctx        context.Context
 	cancelFunc context.CancelFunc
+	// workers are the goroutines using db in the background
+	workers sync.WaitGroup
+	expiry  expiryHooks
+	// cfg is the config.Store setting the expiry of the metadata
+	cfg atomic.Value
+}
+
+// ErrStoreLocked indicates another process, usually a running collector,
+// has the store open
+var ErrStoreLocked = errors.New("Store is in use by another process")
+
+// isLockError tells whether err comes from badger failing to lock its
+// directory. badger wraps the flock error with github.com/pkg/errors.
+func isLockError(err error) bool {
+	for err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return true
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
 }
 
-// Init checks that the store is usable
+// Init opens the store and upgrades it to SchemaVersion. A closed store can
+// be opened again, an open one is left as is.
 func (s *Storage) Init() error {
+	if err := s.open(); err == nil {
+		s.mu.RUnlock()
+		return nil
+	}
 	db, err := badger.Open(s.opts)
+	if isLockError(err) {
+		return ErrStoreLocked
+	}
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	s.db = db
 	s.ctx, s.cancelFunc = context.WithCancel(context.Background())
-	go s.runGarbageCollection()
+	ctx := s.ctx
+	s.mu.Unlock()
+	if err = s.Migrate(ctx); err != nil {
+		s.Close()
+		return err
+	}
+	s.startWorker(ctx, s.runGarbageCollection)
+	s.startExpiryNotices()
 	return nil
 }
 
-// SetReport writes the report metadata to the store
-func (s *Storage) SetReport(m *ReportMetadata) error {
+// startWorker runs fn in the background until ctx, the context of the
+// store, is done. Close waits for it.
+func (s *Storage) startWorker(ctx context.Context, fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(ctx)
+	}()
+}
+
+// ErrStoreNotOpen indicates the store has not been initialised or has been
+// closed
+var ErrStoreNotOpen = errors.New("Store is not open")
+
+// open locks the store for reading and tells whether it's open. It's
+// unlocked with s.mu.RUnlock.
+func (s *Storage) open() error {
+	s.mu.RLock()
+	if s.db == nil {
+		s.mu.RUnlock()
+		return ErrStoreNotOpen
+	}
+	return nil
+}
+
+// maxConflictRetries is how many times a write conflicting with a concurrent
+// update of the same report is retried
+const maxConflictRetries = 3
+
+// SetReport writes the report metadata to the store, along with its index
+// keys and tombstone. The metadata expires after store.open-metadata-ttl or,
+// once the report is closed, store.closed-metadata-ttl.
+func (s *Storage) SetReport(ctx context.Context, m *ReportMetadata) error {
 	var err error
-	err = s.db.Update(func(txn *badger.Txn) error {
-		var value []byte
-		if value, err = json.Marshal(m); err != nil {
-			return err
+	_, span := tracing.StartSpan(ctx, "storage.SetReport")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+
+	for i := 0; i < maxConflictRetries; i++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			return s.writeReport(txn, m, s.metadataTTL(m))
+		})
+		if err != badger.ErrConflict {
+			break
 		}
-		err = txn.SetWithTTL([]byte(fmt.Sprintf("report/%s", m.ReportID)), value, reportExpiryDuration)
+	}
+	return err
+}
+
+// UpdateReport applies fn to the current metadata of the report and writes
+// it back within a single transaction, so that the concurrent updates of the
+// report are not overwritten. The metadata is left as is when fn returns an
+// error, which UpdateReport returns.
+func (s *Storage) UpdateReport(ctx context.Context, reportID string, fn func(m *ReportMetadata) error) error {
+	var err error
+	_, span := tracing.StartSpan(ctx, "storage.UpdateReport")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
 		return err
+	}
+	defer s.mu.RUnlock()
+
+	for i := 0; i < maxConflictRetries; i++ {
+		err = s.db.Update(func(txn *badger.Txn) error {
+			m, err := getReport(txn, reportID)
+			if err != nil {
+				return err
+			}
+			if err = fn(m); err != nil {
+				return err
+			}
+			return s.writeReport(txn, m, s.metadataTTL(m))
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	return err
+}
+
+// DeleteReport removes the report metadata from the store
+func (s *Storage) DeleteReport(ctx context.Context, reportID string) error {
+	var err error
+	_, span := tracing.StartSpan(ctx, "storage.DeleteReport")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return deleteReport(txn, reportID)
 	})
 	return err
 }
@@ -83,52 +240,59 @@ func (s *Storage) SetReport(m *ReportMetadata) error {
 var ErrReportNotFound = errors.New("Report not found")
 
 // GetReport returns a report based on it's reportID
-func (s *Storage) GetReport(reportID string) (*ReportMetadata, error) {
+func (s *Storage) GetReport(ctx context.Context, reportID string) (*ReportMetadata, error) {
 	var (
 		meta ReportMetadata
 		err  error
 	)
+	_, span := tracing.StartSpan(ctx, "storage.GetReport")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
 	err = s.db.View(func(txn *badger.Txn) error {
-		var (
-			item *badger.Item
-			val  []byte
-		)
-		if item, err = txn.Get([]byte(fmt.Sprintf("report/%s", reportID))); err != nil {
-			if err == badger.ErrKeyNotFound {
-				return ErrReportNotFound
-			}
-			return err
-		}
-		if val, err = item.Value(); err != nil {
-			return err
-		}
-		if err = json.Unmarshal(val, &meta); err != nil {
+		m, err := getReport(txn, reportID)
+		if err != nil {
 			return err
 		}
+		meta = *m
 		return nil
 	})
 	return &meta, err
 }
 
 // ListReports returns all the reports in the store
-func (s *Storage) ListReports() ([]*ReportMetadata, error) {
+func (s *Storage) ListReports(ctx context.Context) ([]*ReportMetadata, error) {
 	var (
 		reports []*ReportMetadata
 		err     error
 	)
+	_, span := tracing.StartSpan(ctx, "storage.ListReports")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
 
-	err = s.db.View(func(txn *badger.Txn) error {
+	reports, err = s.listReports()
+	return reports, err
+}
+
+func (s *Storage) listReports() ([]*ReportMetadata, error) {
+	var reports []*ReportMetadata
+	err := s.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 100
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		prefix := []byte("report/")
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			var val []byte
 			var meta ReportMetadata
 			item := it.Item()
-			if val, err = item.Value(); err != nil {
+			val, err := item.Value()
+			if err != nil {
 				return err
 			}
 			if err = json.Unmarshal(val, &meta); err != nil {
@@ -141,35 +305,146 @@ func (s *Storage) ListReports() ([]*ReportMetadata, error) {
 	return reports, err
 }
 
-// Close the database cleanly
+// Filter selects reports by their metadata. Empty fields match any report.
+type Filter struct {
+	// State is either open or closed
+	State    string
+	TestName string
+	ProbeCC  string
+	ProbeASN string
+	// UpdatedBefore selects the reports not updated since then
+	UpdatedBefore time.Time
+}
+
+// Report states
+const (
+	StateOpen   = "open"
+	StateClosed = "closed"
+)
+
+// State returns the state of the report, open or closed
+func (m *ReportMetadata) State() string {
+	if m.Closed {
+		return StateClosed
+	}
+	return StateOpen
+}
+
+// Match tells whether the report is selected by the filter
+func (f Filter) Match(m *ReportMetadata) bool {
+	return (f.State == "" || f.State == m.State()) &&
+		(f.TestName == "" || f.TestName == m.TestName) &&
+		(f.ProbeCC == "" || f.ProbeCC == m.ProbeCC) &&
+		(f.ProbeASN == "" || f.ProbeASN == m.ProbeASN) &&
+		(f.UpdatedBefore.IsZero() || m.LastUpdateTime.Before(f.UpdatedBefore))
+}
+
+// FindReports returns the reports in the store selected by the filter. It
+// reads only the reports of the most selective index matching the filter,
+// and all of them when none does (ex. when filtering on the probe ASN only).
+func (s *Storage) FindReports(ctx context.Context, f Filter) ([]*ReportMetadata, error) {
+	var (
+		found   []*ReportMetadata
+		indexed bool
+		err     error
+	)
+	_, span := tracing.StartSpan(ctx, "storage.FindReports")
+	defer func() { tracing.EndSpan(span, err) }()
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	err = s.db.View(func(txn *badger.Txn) error {
+		found, indexed, err = findIndexed(txn, f)
+		return err
+	})
+	if err != nil || indexed {
+		return found, err
+	}
+
+	reports, err := s.listReports()
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range reports {
+		if f.Match(meta) {
+			found = append(found, meta)
+		}
+	}
+	return found, nil
+}
+
+// Ping checks that the store can serve transactions
+func (s *Storage) Ping() error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	defer s.mu.RUnlock()
+	return s.db.View(func(txn *badger.Txn) error {
+		return nil
+	})
+}
+
+// Close the database cleanly once the background goroutines are done.
+// Closing it flushes the writes to the tables, which keeps their expiry.
+// Afterwards the methods return ErrStoreNotOpen. It can be called again once
+// closed.
 func (s *Storage) Close() error {
-	// cancel (db) context
-	s.cancelFunc()
-	// close db
+	s.mu.RLock()
+	cancel := s.cancelFunc
+	s.mu.RUnlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	s.workers.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
 	err := s.db.Close()
-	if err != nil {
+	s.db = nil
+	s.cancelFunc = nil
+	s.expiry.Lock()
+	s.expiry.watching = false
+	s.expiry.Unlock()
+	return err
+}
+
+// runValueLogGC runs a garbage collection of the value log unless the store
+// has been closed
+func (s *Storage) runValueLogGC() error {
+	if err := s.open(); err != nil {
 		return err
 	}
-	return nil
+	defer s.mu.RUnlock()
+	return s.db.RunValueLogGC(discardRatio)
 }
 
-func (s *Storage) runGarbageCollection() {
+func (s *Storage) runGarbageCollection(ctx context.Context) {
 	ticker := time.NewTicker(garbageCollectionInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			err := s.db.RunValueLogGC(discardRatio)
+			err := s.runValueLogGC()
 			if err != nil {
 				// don't report error when gc didn't result in any cleanup
 				if err == badger.ErrNoRewrite {
 					log.Debugf("Badger GC: %v", err)
+					metrics.BadgerGC.WithLabelValues("no-rewrite").Inc()
 				} else {
 					log.Errorf("Badger GC failed: %v", err)
+					metrics.BadgerGC.WithLabelValues("error").Inc()
 				}
+			} else {
+				metrics.BadgerGC.WithLabelValues("rewrite").Inc()
 			}
-		case <-s.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
 	}
-
 }
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/ooni/collector/collector/config"
+	"github.com/spf13/viper"
+)
+
+// testConfig returns the default [store] section
+func testConfig(t *testing.T) config.Store {
+	v := viper.New()
+	config.SetDefaults(v)
+	v.Set("core.is-dev", true)
+	v.Set("core.data-root", os.TempDir())
+	c, err := config.Load(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Store
+}
+
+// testDir creates a temporary directory for a store
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// openTestStore opens the store in dir with the default configuration. The
+// returned function closes and removes it.
+func openTestStore(t *testing.T, dir string) (*Storage, func()) {
+	s := New(dir, testConfig(t))
+	if err := s.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestStore opens a new store in a temporary directory with the default
+// configuration. The returned function closes and removes it.
+func newTestStore(t *testing.T) (*Storage, func()) {
+	return openTestStore(t, testDir(t))
+}
+
+// writeRaw writes the keys and values to the badger database in dir,
+// bypassing the store, ex. to lay out an older schema. The keys expire in an
+// hour.
+func writeRaw(t *testing.T, dir string, kv map[string]string) {
+	writeRawWithTTL(t, dir, kv, time.Hour)
+}
+
+// writeRawWithTTL is writeRaw with the keys expiring after ttl, never if it's
+// zero
+func writeRawWithTTL(t *testing.T, dir string, kv map[string]string, ttl time.Duration) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(txn *badger.Txn) error {
+		for k, v := range kv {
+			var err error
+			if ttl == 0 {
+				err = txn.Set([]byte(k), []byte(v))
+			} else {
+				err = txn.SetWithTTL([]byte(k), []byte(v), ttl)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testReport(id string) *ReportMetadata {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &ReportMetadata{
+		ReportID:       id,
+		ProbeASN:       "AS1",
+		ProbeCC:        "IT",
+		TestName:       "web_connectivity",
+		CreationTime:   now,
+		LastUpdateTime: now,
+		EntryCount:     1,
+	}
+}
+
+// keys returns the keys of the store starting with prefix
+func keys(t *testing.T, s *Storage, prefix string) []string {
+	var found []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(prefix)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			found = append(found, string(it.Item().Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestClosedStore(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := s.GetReport(ctx, "r1"); err != ErrStoreNotOpen {
+		t.Errorf("GetReport on a closed store: %v", err)
+	}
+	if err := s.SetReport(ctx, testReport("r1")); err != ErrStoreNotOpen {
+		t.Errorf("SetReport on a closed store: %v", err)
+	}
+	if err := s.Ping(); err != ErrStoreNotOpen {
+		t.Errorf("Ping on a closed store: %v", err)
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("reopening the store: %v", err)
+	}
+	if err := s.Ping(); err != nil {
+		t.Errorf("Ping once reopened: %v", err)
+	}
+}
+
+func TestMarkUploaded(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// The metadata of the report expired but its tombstone is left
+	m := testReport("r1")
+	m.Closed = true
+	if err := s.SetReport(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return deleteReport(txn, m.ReportID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MarkUploaded(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	tomb, err := s.GetTombstone(ctx, m.ReportID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tomb.Uploaded != true {
+		t.Error("the tombstone doesn't record the upload")
+	}
+	if _, err = s.GetReport(ctx, m.ReportID); err != ErrReportNotFound {
+		t.Errorf("the metadata was written back: %v", err)
+	}
+	if found := keys(t, s, "index/"); len(found) > 0 {
+		t.Errorf("index keys were written back: %v", found)
+	}
+
+	// Without a tombstone one is created
+	m2 := testReport("r2")
+	m2.Closed = true
+	if err = s.MarkUploaded(ctx, m2); err != nil {
+		t.Fatal(err)
+	}
+	if tomb, err = s.GetTombstone(ctx, m2.ReportID); err != nil || tomb.Uploaded != true {
+		t.Errorf("tombstone of r2 = %+v, %v", tomb, err)
+	}
+
+	// The reports whose metadata is in the store are updated through it
+	if err = s.SetReport(ctx, testReport("r3")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MarkUploaded(ctx, testReport("r3")); err == nil {
+		t.Error("marked a report whose metadata is in the store")
+	}
+}
@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apexLog "github.com/apex/log"
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var log = apexLog.WithFields(apexLog.Fields{
+	"pkg": "tracing",
+	"cmd": "ooni-collector",
+})
+
+const tracerName = "github.com/ooni/collector"
+
+// Init configures the OpenTelemetry tracer provider from the tracing section
+// of the configuration. When tracing is disabled spans are no-ops. The
+// returned function flushes the pending spans and must be called on exit.
+func Init(version string, cfg config.Tracing) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(cfg.Endpoint),
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", cfg.ServiceName),
+		attribute.String("service.version", version),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(cfg.SampleRatio),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	log.Infof("exporting traces to %s", cfg.Endpoint)
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span named name as a child of the span in ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartLinkedSpan starts a new trace for work that outlives the span in ctx,
+// such as background uploads, and links it to that span. The returned
+// context keeps the values of ctx (ex. the request ID) but is not canceled
+// with it.
+func StartLinkedSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	link := trace.LinkFromContext(ctx)
+	return otel.Tracer(tracerName).Start(context.WithoutCancel(ctx), name,
+		trace.WithNewRoot(),
+		trace.WithAttributes(attrs...),
+		trace.WithLinks(link),
+	)
+}
+
+// EndSpan records err, if any, on the span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// route returns the path of the request with the values of the parameters
+// replaced by their names (ex. /report/:reportID)
+func route(c *gin.Context) string {
+	path := c.Request.URL.Path
+	for _, p := range c.Params {
+		path = strings.Replace(path, p.Value, ":"+p.Key, 1)
+	}
+	return path
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// propagated in the incoming headers
+func Middleware() gin.HandlerFunc {
+	propagator := otel.GetTextMapPropagator()
+	return func(c *gin.Context) {
+		ctx := propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		path := route(c)
+		ctx, span := otel.Tracer(tracerName).Start(ctx,
+			fmt.Sprintf("%s %s", c.Request.Method, path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", c.Request.Method),
+				attribute.String("http.route", path),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+	}
+}
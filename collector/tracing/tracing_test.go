@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ooni/collector/collector/config"
+	"github.com/ooni/collector/collector/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// standInCollector is an OTLP/HTTP endpoint keeping the spans exported to it
+type standInCollector struct {
+	*httptest.Server
+	mu    sync.Mutex
+	spans map[string]trace.SpanID
+	links map[string][]byte
+}
+
+func newStandInCollector(t *testing.T) *standInCollector {
+	c := &standInCollector{
+		spans: make(map[string]trace.SpanID),
+		links: make(map[string][]byte),
+	}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var req coltracepb.ExportTraceServiceRequest
+		if err = proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid export request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					var id trace.SpanID
+					copy(id[:], span.SpanId)
+					c.spans[span.Name] = id
+					for _, link := range span.Links {
+						c.links[span.Name] = link.SpanId
+					}
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(nil)
+	}))
+	return c
+}
+
+func TestExportToCollector(t *testing.T) {
+	c := newStandInCollector(t)
+	defer c.Close()
+
+	shutdown, err := Init("test", config.Tracing{
+		Enabled:     true,
+		Endpoint:    strings.TrimPrefix(c.URL, "http://"),
+		Insecure:    true,
+		ServiceName: "ooni-collector",
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, span := StartSpan(context.Background(), "request")
+	_, linked := StartLinkedSpan(ctx, "upload")
+	if linked.SpanContext().TraceID() == span.SpanContext().TraceID() {
+		t.Error("the linked span is in the trace of the request")
+	}
+	linked.End()
+	span.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.spans["request"]; !ok {
+		t.Fatalf("spans exported: %v", c.spans)
+	}
+	want := c.spans["request"]
+	if string(c.links["upload"]) != string(want[:]) {
+		t.Errorf("upload linked to %x, want %s", c.links["upload"], want)
+	}
+}
+
+func TestStartLinkedSpanKeepsValues(t *testing.T) {
+	// A request carrying an ID, canceled once answered
+	req := httptest.NewRequest("POST", "/report", nil)
+	req.Header.Set(logging.RequestIDHeader, "abc")
+	var ctx context.Context
+	router := gin.New()
+	router.Use(logging.RequestIDMiddleware())
+	router.POST("/report", func(c *gin.Context) { ctx = c.Request.Context() })
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	detached, span := StartLinkedSpan(ctx, "upload")
+	defer span.End()
+	if id := logging.RequestID(detached); id != "abc" {
+		t.Errorf("request ID = %q, want abc", id)
+	}
+	if detached.Err() != nil {
+		t.Errorf("the linked span context is canceled with the request: %v", detached.Err())
+	}
+}
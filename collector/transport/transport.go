@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HTTPS is the transport of the requests reaching the collector directly
+	// or through a reverse proxy
+	HTTPS = "https"
+	// Onion is the transport of the requests coming from the tor onion
+	// service listener
+	Onion = "onion"
+	// CloudFront is the transport of the requests domain fronted through
+	// CloudFront
+	CloudFront = "cloudfront"
+)
+
+type transportKey struct{}
+
+// NewContext returns a copy of ctx carrying the transport t
+func NewContext(ctx context.Context, t string) context.Context {
+	return context.WithValue(ctx, transportKey{}, t)
+}
+
+// FromContext returns the transport of the request ctx belongs to,
+// defaulting to HTTPS
+func FromContext(ctx context.Context) string {
+	t, ok := ctx.Value(transportKey{}).(string)
+	if !ok {
+		return HTTPS
+	}
+	return t
+}
+
+// IsOnion tells whether the request ctx belongs to came over tor, in which
+// case the client address is the one of the local tor daemon and is not to
+// be used
+func IsOnion(ctx context.Context) bool {
+	return FromContext(ctx) == Onion
+}
+
+// isCloudFront tells whether the request carries the headers set by
+// CloudFront
+func isCloudFront(r *http.Request) bool {
+	if r.Header.Get("X-Amz-Cf-Id") != "" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Via"), "CloudFront")
+}
+
+// Handler tags the requests served by h with their transport. Requests on
+// the onion listener are always Onion. The others are CloudFront when they
+// carry the CloudFront headers and fromProxy tells they were sent by a
+// trusted proxy, as any client can set the headers, and HTTPS otherwise.
+func Handler(h http.Handler, onion bool, fromProxy func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := HTTPS
+		if onion {
+			t = Onion
+		} else if isCloudFront(r) && fromProxy(r) {
+			t = CloudFront
+		}
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), t)))
+	})
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	trusted := func(r *http.Request) bool { return r.RemoteAddr == "10.0.0.1:1234" }
+	tests := []struct {
+		name    string
+		onion   bool
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "direct", remote: "192.0.2.1:1234", want: HTTPS},
+		{name: "onion", onion: true, remote: "192.0.2.1:1234", want: Onion},
+		{
+			name:    "onion with cloudfront headers",
+			onion:   true,
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Amz-Cf-Id": "abc"},
+			want:    Onion,
+		},
+		{
+			name:    "cloudfront id from a trusted proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"X-Amz-Cf-Id": "abc"},
+			want:    CloudFront,
+		},
+		{
+			name:    "cloudfront via from a trusted proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Via": "1.1 abc.cloudfront.net (CloudFront)"},
+			want:    CloudFront,
+		},
+		{
+			name:    "cloudfront id from a client",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"X-Amz-Cf-Id": "abc"},
+			want:    HTTPS,
+		},
+		{
+			name:    "cloudfront via from a client",
+			remote:  "192.0.2.1:1234",
+			headers: map[string]string{"Via": "1.1 abc.cloudfront.net (CloudFront)"},
+			want:    HTTPS,
+		},
+		{
+			name:    "other proxy",
+			remote:  "10.0.0.1:1234",
+			headers: map[string]string{"Via": "1.1 varnish"},
+			want:    HTTPS,
+		},
+	}
+	for _, tt := range tests {
+		var got string
+		h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = FromContext(r.Context())
+		}), tt.onion, trusted)
+		req := httptest.NewRequest("POST", "/report", nil)
+		req.RemoteAddr = tt.remote
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got != tt.want {
+			t.Errorf("%s: transport = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
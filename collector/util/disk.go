@@ -0,0 +1,15 @@
+package util
+
+import "syscall"
+
+// DiskUsage returns the total and the available bytes of the filesystem
+// containing path
+func DiskUsage(path string) (total uint64, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	total = uint64(st.Blocks) * uint64(st.Bsize)
+	avail = uint64(st.Bavail) * uint64(st.Bsize)
+	return total, avail, nil
+}